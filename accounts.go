@@ -0,0 +1,57 @@
+package main
+
+import (
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/charmbracelet/log"
+)
+
+// Account statuses, from com.atproto.sync.subscribeRepos#account, that we
+// act on. Other statuses, such as throttled or desynchronized, are passing
+// trouble with the account's host and leave its posts alone.
+const (
+	accountDeleted     = "deleted"
+	accountTakendown   = "takendown"
+	accountSuspended   = "suspended"
+	accountDeactivated = "deactivated"
+)
+
+// HiddenAuthor records an account whose posts are hidden, so that only
+// those accounts need their posts shown again when they are active. Its URI
+// is the account's DID, as an account is hidden at most once.
+type HiddenAuthor struct {
+	URI string `gorm:"primaryKey"`
+	Did string `gorm:"index"`
+}
+
+// HandleAccount follows an account through its lifecycle. Posts by deleted
+// accounts are purged, posts by accounts that are taken down, suspended or
+// deactivated are hidden, and hidden posts come back when the account is
+// active again.
+//
+// Identity events, for changes of handle or DID document, are left alone, as
+// posts are kept by DID and a feed never shows handles.
+func (feed *Feed) HandleAccount(acct *comatproto.SyncSubscribeRepos_Account) {
+	if acct.Active {
+		// most accounts are active and were never hidden
+		if _, ok, _ := feed.hidden.remove(feed, acct.Did); ok {
+			feed.hideAuthor(acct.Did, false, "active")
+		}
+		return
+	}
+	status := ""
+	if acct.Status != nil {
+		status = *acct.Status
+	}
+	switch status {
+	case accountDeleted:
+		feed.hidden.remove(feed, acct.Did)
+		feed.purgeAuthor(acct.Did, "account deleted")
+	case accountTakendown, accountSuspended, accountDeactivated:
+		// marked straight away, so that an active event queued behind this
+		// restores what it hides
+		feed.hidden.mark(acct.Did, acct.Did)
+		feed.hideAuthor(acct.Did, true, status)
+	default:
+		log.Debug("Ignoring account status", "feed", feed.ID, "did", acct.Did, "status", status)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"gorm.io/gorm"
+)
+
+const (
+	postPending = "pending"
+
+	defaultAdmissionWindow   = 6 * time.Hour
+	defaultAdmissionInterval = time.Minute
+)
+
+// AdmissionConfig holds matching posts back from the feed until enough
+// likes and reposts show they are worth surfacing.
+type AdmissionConfig struct {
+	Threshold int64  `hcl:"threshold"`
+	Window    string `hcl:"window,optional"`
+	Interval  string `hcl:"interval,optional"`
+	window    time.Duration
+	interval  time.Duration
+}
+
+func (ac *AdmissionConfig) parse() error {
+	var err error
+	if ac.Threshold < 1 {
+		return fmt.Errorf("admission threshold must be at least 1")
+	}
+	ac.window = defaultAdmissionWindow
+	if ac.Window != "" {
+		if ac.window, err = time.ParseDuration(ac.Window); err != nil {
+			return fmt.Errorf("invalid admission window: %w", err)
+		}
+	}
+	ac.interval = defaultAdmissionInterval
+	if ac.Interval != "" {
+		if ac.interval, err = time.ParseDuration(ac.Interval); err != nil {
+			return fmt.Errorf("invalid admission interval: %w", err)
+		}
+	}
+	return nil
+}
+
+// runAdmission periodically promotes pending posts that have reached the
+// threshold, and expires those that didn't within the window.
+func (feed *Feed) runAdmission(ctx context.Context) {
+	ac := feed.Admission
+	if ac == nil {
+		return
+	}
+	ticker := time.NewTicker(ac.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			feed.admitPosts()
+		}
+	}
+}
+
+// admitPosts queues a pass over the pending posts. Promoted posts are placed
+// in the feed at the time they were promoted, as that is when they appear.
+func (feed *Feed) admitPosts() {
+	ac := feed.Admission
+	feed.ch <- func(db *gorm.DB) {
+		now := time.Now()
+		res := db.Model(&Post{}).
+			Where("state = ? and likes + reposts >= ?", postPending, ac.Threshold).
+			Updates(map[string]any{"state": "", "indexed_at": fmt.Sprintf("%d", now.UnixMilli())})
+		if res.Error != nil {
+			log.Error("Failed to promote pending posts", "feed", feed.ID, "error", res.Error)
+		} else if res.RowsAffected > 0 {
+			n := feed.stats.Admitted.Add(res.RowsAffected)
+			log.Debug("Promoted pending posts", "feed", feed.ID, "posts", res.RowsAffected, "total_admitted", n)
+		}
+
+		cutoff := fmt.Sprintf("%d", now.Add(-ac.window).UnixMilli())
+		err := db.Transaction(func(tx *gorm.DB) error {
+			expired := tx.Model(&Post{}).Select("uri").Where("state = ? and indexed_at < ?", postPending, cutoff)
+			if err := tx.Where("subject in (?)", expired).Delete(&Engagement{}).Error; err != nil {
+				return err
+			}
+			res := tx.Where("state = ? and indexed_at < ?", postPending, cutoff).Delete(&Post{})
+			if res.Error == nil && res.RowsAffected > 0 {
+				feed.stats.Expired.Add(res.RowsAffected)
+			}
+			return res.Error
+		})
+		if err != nil {
+			log.Error("Failed to expire pending posts", "feed", feed.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+const defaultAppView = "https://public.api.bsky.app"
+
+// appViewTimeout is how long we wait on the AppView for a post.
+const appViewTimeout = 10 * time.Second
+
+// appViewClient returns an unauthenticated client for the configured
+// AppView, which serves the public views of posts, lists and profiles.
+func appViewClient() *xrpc.Client {
+	return &xrpc.Client{
+		Client: NewHttpClient(),
+		Host:   cfg.AppView,
+	}
+}
+
+// fetchPost looks a post up on the AppView, for when we need the content of
+// a post we haven't seen an event for.
+func fetchPost(ctx context.Context, uri string) (*ParsedPost, error) {
+	aturi, err := syntax.ParseATURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	out, err := apibsky.FeedGetPosts(ctx, appViewClient(), []string{uri})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Posts) == 0 || out.Posts[0].Record == nil {
+		return nil, fmt.Errorf("post %s not found", uri)
+	}
+	view := out.Posts[0]
+	record, ok := view.Record.Val.(*apibsky.FeedPost)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a post", uri)
+	}
+	return newParsedPost(aturi.Authority().String(), aturi.RecordKey().String(), view.Cid, models.CommitOperationCreate, 0, record), nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultArchiveMaxAge  = 24 * time.Hour
+	defaultArchiveSegment = time.Hour
+
+	archivePrefix = "posts-"
+	archiveSuffix = ".jsonl.zst"
+)
+
+// eventArchive keeps recent post events on disk, in segment files that are
+// pruned once the archive grows too old or too large, so that new feeds can
+// be backfilled from them.
+type eventArchive struct {
+	dir     string
+	maxSize uint64
+	maxAge  time.Duration
+	segment time.Duration
+	current string
+	started time.Time
+	w       *eventWriter
+	sync.Mutex
+}
+
+func openArchive(ac *ArchiveConfig) (*eventArchive, error) {
+	if err := os.MkdirAll(ac.Path, 0755); err != nil {
+		return nil, err
+	}
+	a := &eventArchive{
+		dir:     ac.Path,
+		maxSize: ac.maxSize,
+		maxAge:  ac.maxAge,
+		segment: ac.segment,
+	}
+	if err := a.rotate(); err != nil {
+		return nil, err
+	}
+	log.Info("Archiving post events", "path", a.dir, "max_size", a.maxSize, "max_age", a.maxAge)
+	return a, nil
+}
+
+// Add appends an event to the current segment, starting a new one when the
+// current segment is old enough.
+func (a *eventArchive) Add(event *models.Event) {
+	a.Lock()
+	defer a.Unlock()
+	if a.w == nil {
+		return
+	}
+	if time.Since(a.started) >= a.segment {
+		if err := a.rotate(); err != nil {
+			log.Error("Failed to rotate archive", "path", a.dir, "error", err)
+			return
+		}
+	}
+	if err := a.w.Write(event); err != nil {
+		log.Error("Failed to archive event", "path", a.current, "error", err)
+	}
+}
+
+// rotate closes the current segment, prunes old ones and starts a new one. It
+// must be called with the lock held.
+func (a *eventArchive) rotate() error {
+	if a.w != nil {
+		if err := a.w.Close(); err != nil {
+			log.Error("Failed to close archive segment", "path", a.current, "error", err)
+		}
+		a.w = nil
+	}
+	a.prune()
+
+	a.started = time.Now()
+	a.current = filepath.Join(a.dir, fmt.Sprintf("%s%d%s", archivePrefix, a.started.UnixMicro(), archiveSuffix))
+	w, err := openEventWriter(a.current)
+	if err != nil {
+		return err
+	}
+	a.w = w
+	return nil
+}
+
+// segments lists the archive's segment files, oldest first.
+func (a *eventArchive) segments() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(a.dir, archivePrefix+"*"+archiveSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return segmentTime(paths[i]).Before(segmentTime(paths[j]))
+	})
+	return paths, nil
+}
+
+// segmentTime returns when a segment was started, from its file name.
+func segmentTime(path string) time.Time {
+	var us int64
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), archivePrefix), archiveSuffix)
+	fmt.Sscanf(name, "%d", &us)
+	return time.UnixMicro(us)
+}
+
+// prune removes the oldest segments until the archive is within its limits.
+func (a *eventArchive) prune() {
+	paths, err := a.segments()
+	if err != nil {
+		log.Error("Failed to list archive", "path", a.dir, "error", err)
+		return
+	}
+	// segments closed without any events in them are of no use
+	var total uint64
+	sizes := make([]uint64, 0, len(paths))
+	kept := paths[:0]
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if fi.Size() == 0 && path != a.current {
+			os.Remove(path)
+			continue
+		}
+		kept = append(kept, path)
+		sizes = append(sizes, uint64(fi.Size()))
+		total += uint64(fi.Size())
+	}
+	paths = kept
+	for i, path := range paths {
+		// a segment is only too old once the segment after it started
+		// before the cutoff, as until then it holds events we still want
+		tooOld := false
+		if a.maxAge > 0 && i+1 < len(paths) {
+			tooOld = time.Since(segmentTime(paths[i+1])) > a.maxAge
+		}
+		tooBig := a.maxSize > 0 && total > a.maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+		if err := os.Remove(path); err != nil {
+			log.Error("Failed to prune archive segment", "path", path, "error", err)
+			break
+		}
+		log.Debug("Pruned archive segment", "path", path)
+		total -= sizes[i]
+	}
+}
+
+func (a *eventArchive) Close() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.w == nil {
+		return nil
+	}
+	err := a.w.Close()
+	a.w = nil
+	return err
+}
+
+// Backfill runs every archived event through the feed, indexing matches at
+// the time they were originally seen. A new segment is started first, so
+// everything archived so far can be read back.
+func (a *eventArchive) Backfill(ctx context.Context, feed *Feed) (int, error) {
+	a.Lock()
+	err := a.rotate()
+	current := a.current
+	a.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	paths, err := a.segments()
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, path := range paths {
+		if path == current {
+			continue
+		}
+		n, err := readEventFile(ctx, path, func(event *models.Event) {
+			if event.Commit == nil || event.Commit.Collection != "app.bsky.feed.post" {
+				return
+			}
+			post, err := parsePost(event)
+			if err != nil {
+				log.Debug("Failed to backfill post", "feed", feed.ID, "error", err)
+				return
+			}
+			// quoted posts aren't fetched for the whole archive
+			feed.HandlePost(post, time.UnixMicro(event.TimeUS), nil)
+		})
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	return total, nil
+}
+
+// startBackfill backfills a feed from the archive if it is new, or its
+// matching config has changed since it was last backfilled. The archive is
+// read in the background, so as not to hold up live events for other feeds,
+// while the feed's own live posts are held back until it is done.
+func startBackfill(feed *Feed, archive *eventArchive) {
+	if archive == nil || feed.db == nil {
+		return
+	}
+	sig := feed.MatchSignature()
+	saved, err := loadBackfillSignature(feed.db)
+	if err != nil {
+		log.Error("Failed to load feed signature", "feed", feed.ID, "error", err)
+		return
+	}
+	if saved == sig {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	feed.stopBackfill = func() {
+		cancel()
+		<-done
+	}
+	feed.worker.Hold()
+	go func() {
+		defer close(done)
+		defer feed.worker.Release()
+		log.Info("Backfilling feed from archive", "feed", feed.ID)
+		started := time.Now()
+		n, err := archive.Backfill(ctx, feed)
+		if err != nil {
+			log.Error("Failed to backfill feed", "feed", feed.ID, "error", err)
+			return
+		}
+		log.Info("Backfilled feed from archive", "feed", feed.ID, "events", n, "elapsed", time.Since(started))
+		feed.ch <- func(db *gorm.DB) {
+			if err := saveBackfillSignature(db, sig); err != nil {
+				log.Error("Failed to save feed signature", "feed", feed.ID, "error", err)
+			}
+		}
+	}()
+}
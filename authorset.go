@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// authorSet is a set of authors, each in it by way of one or more records
+// such as likes, follows or blocks. The records are kept in a table of the
+// feed database, so that deleting a record can take its author out again.
+type authorSet struct {
+	table   string
+	records map[string]string
+	members map[string]int
+	sync.RWMutex
+}
+
+// authorRecord is a row of an authorSet's table.
+type authorRecord struct {
+	URI string
+	Did string
+}
+
+// load reads the set from its table in db, which may be nil for an empty set.
+func (s *authorSet) load(db *gorm.DB) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records = map[string]string{}
+	s.members = map[string]int{}
+	if db == nil {
+		return nil
+	}
+	var rows []authorRecord
+	if err := db.Table(s.table).Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		s.records[row.URI] = row.Did
+		s.members[row.Did]++
+	}
+	return nil
+}
+
+// Has reports whether did is in the set.
+func (s *authorSet) Has(did string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.members[did] > 0
+}
+
+func (s *authorSet) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.members)
+}
+
+// add puts did in the set by way of the record at uri, and reports whether
+// the record is new and whether did wasn't in the set before. New records
+// are saved through the feed's writer.
+func (s *authorSet) add(feed *Feed, uri, did string) (bool, bool) {
+	s.Lock()
+	if _, seen := s.records[uri]; seen {
+		s.Unlock()
+		return false, false
+	}
+	s.records[uri] = did
+	s.members[did]++
+	joined := s.members[did] == 1
+	s.Unlock()
+
+	feed.ch <- func(db *gorm.DB) {
+		db.Table(s.table).Create(&authorRecord{URI: uri, Did: did})
+	}
+	return true, joined
+}
+
+// mark puts did in the set by way of the record at uri without saving it,
+// for when whether it belongs there is only known once the feed's writer
+// gets to it, which settles it.
+func (s *authorSet) mark(uri, did string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, seen := s.records[uri]; !seen {
+		s.records[uri] = did
+		s.members[did]++
+	}
+}
+
+// settle puts the record at uri in the set and saves it with db, or takes
+// it out of both, from within the feed's writer.
+func (s *authorSet) settle(db *gorm.DB, uri, did string, in bool) {
+	s.Lock()
+	_, seen := s.records[uri]
+	switch {
+	case in && !seen:
+		s.records[uri] = did
+		s.members[did]++
+	case !in && seen:
+		delete(s.records, uri)
+		if s.members[did]--; s.members[did] <= 0 {
+			delete(s.members, did)
+		}
+	}
+	s.Unlock()
+	if in {
+		db.Table(s.table).Clauses(clause.OnConflict{DoNothing: true}).Create(&authorRecord{URI: uri, Did: did})
+	} else {
+		db.Table(s.table).Where("uri = ?", uri).Delete(&authorRecord{})
+	}
+}
+
+// remove takes the record at uri out of the set, returning its author, and
+// whether it was in the set and whether the author has now left it.
+func (s *authorSet) remove(feed *Feed, uri string) (string, bool, bool) {
+	s.Lock()
+	did, ok := s.records[uri]
+	left := false
+	if ok {
+		delete(s.records, uri)
+		if s.members[did]--; s.members[did] <= 0 {
+			delete(s.members, did)
+			left = true
+		}
+	}
+	s.Unlock()
+	if !ok {
+		return "", false, false
+	}
+
+	feed.ch <- func(db *gorm.DB) {
+		db.Table(s.table).Where("uri = ?", uri).Delete(&authorRecord{})
+	}
+	return did, true, left
+}
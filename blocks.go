@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+)
+
+const blockCollection = "app.bsky.graph.block"
+
+// Block is a block of the feed owner, by which an author is kept out of the
+// feed.
+type Block struct {
+	URI string `gorm:"primaryKey"`
+	Did string `gorm:"index"`
+}
+
+// blocksOwner reports whether did is kept out of the feed for blocking the
+// feed owner.
+func (feed *Feed) blocksOwner(did string) bool {
+	return !feed.IgnoreBlocks && feed.blocked.Has(did)
+}
+
+// handleBlock keeps authors who block the feed owner out of the feed,
+// purging what they already have in it, until they unblock.
+func (feed *Feed) handleBlock(e *ParsedEngagement) {
+	if e.IsDelete() {
+		if did, ok, left := feed.blocked.remove(feed, e.URI); ok && left {
+			log.Info("Author unblocked feed owner", "feed", feed.ID, "did", did)
+		}
+		return
+	}
+	if e.Operation != models.CommitOperationCreate || e.Subject != cfg.Base {
+		return
+	}
+	if _, joined := feed.blocked.add(feed, e.URI, e.Did); joined {
+		log.Info("Author blocked feed owner, removing their posts", "feed", feed.ID, "did", e.Did)
+		feed.purgeAuthor(e.Did, "blocked feed owner")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+	"github.com/ipfs/go-cid"
+)
+
+var fBackfillCarFeed = flag.String("backfill-car", "", "Feed name to backfill from the repository CAR files given as arguments")
+
+// backfillCars runs the posts in each CAR file, as exported by
+// com.atproto.sync.getRepo, through the named feed.
+func backfillCars(ctx context.Context, feedName string, paths []string) error {
+	var feed *Feed
+	for _, f := range cfg.Feeds {
+		if f.ID == feedName {
+			feed = f
+		}
+	}
+	if feed == nil {
+		return fmt.Errorf("feed %q not found in config", feedName)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no CAR files given")
+	}
+	if _, err := postWriter(ctx, feed); err != nil {
+		return err
+	}
+	if err := feed.loadAuthors(); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		n, err := backfillCar(ctx, feed, path)
+		if err != nil {
+			return fmt.Errorf("backfilling from %s: %w", path, err)
+		}
+		log.Info("Backfilled feed from CAR file", "feed", feed.ID, "path", path, "posts", n)
+	}
+	feed.flush()
+	return nil
+}
+
+func backfillCar(ctx context.Context, feed *Feed, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r, err := repo.ReadRepoFromCar(ctx, f)
+	if err != nil {
+		return 0, err
+	}
+	did := r.RepoDid()
+	bs := r.Blockstore()
+
+	const collection = "app.bsky.feed.post"
+	var count int
+	err = r.ForEach(ctx, collection, func(k string, v cid.Cid) error {
+		// the walk carries on past the collection we asked for
+		col, rkey, _ := strings.Cut(k, "/")
+		if col != collection {
+			return repo.ErrDoneIterating
+		}
+
+		blk, err := bs.Get(ctx, v)
+		if err != nil {
+			return err
+		}
+		rec, err := lexutil.CborDecodeValue(blk.RawData())
+		if err != nil {
+			log.Warn("Skipping undecodable record", "did", did, "rkey", rkey, "error", err)
+			return nil
+		}
+		post, ok := rec.(*apibsky.FeedPost)
+		if !ok {
+			return nil
+		}
+		// keep the post's place in the feed at the time it was written
+		createdAt := time.Now()
+		if dt, err := syntax.ParseDatetimeLenient(post.CreatedAt); err == nil && dt.Time().Before(createdAt) {
+			createdAt = dt.Time()
+		}
+
+		parsed := newParsedPost(did, rkey, v.String(), models.CommitOperationCreate, createdAt.UnixMicro(), post)
+		// quoted posts aren't fetched for every post in the repo
+		if err, _ := feed.HandlePost(parsed, createdAt, nil); err != nil {
+			log.Warn("Failed to backfill post", "did", did, "rkey", rkey, "error", err)
+		}
+		count++
+		return nil
+	})
+	// the repo only expects to see its sentinel unwrapped
+	if errors.Is(err, repo.ErrDoneIterating) {
+		err = nil
+	}
+	return count, err
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+
 	"github.com/charmbracelet/log"
+	"github.com/dustin/go-humanize"
 
 	"github.com/hashicorp/hcl/v2/hclsimple"
 )
@@ -12,6 +18,17 @@ type Config struct {
 	Feeds     []*Feed           `hcl:"feed,block"`
 	Debug     bool              `hcl:"debug,optional"`
 	Analyzers []*AnalyzerConfig `hcl:"analyzer,block"`
+	Jetstream *JetstreamConfig  `hcl:"jetstream,block"`
+	Archive   *ArchiveConfig    `hcl:"archive,block"`
+	AppView   string            `hcl:"appview,optional"`
+
+	// CursorInterval is how often the jetstream cursor is checkpointed to the
+	// feed databases, and CursorRewind is how far behind the saved cursor we
+	// resume from, to cover events that were still queued when we stopped.
+	CursorInterval string `hcl:"cursor_interval,optional"`
+	CursorRewind   string `hcl:"cursor_rewind,optional"`
+	cursorInterval time.Duration
+	cursorRewind   time.Duration
 }
 
 type PublishConfig struct {
@@ -23,6 +40,31 @@ type PublishConfig struct {
 	ServiceDID         string `hcl:"service_did"`
 }
 
+type JetstreamConfig struct {
+	Endpoints  []string `hcl:"endpoints,optional"`
+	BackoffMin string   `hcl:"backoff_min,optional"`
+	BackoffMax string   `hcl:"backoff_max,optional"`
+	backoffMin time.Duration
+	backoffMax time.Duration
+
+	// Scheduler is how events are handed to the feeds, either "sequential"
+	// or "parallel" across Workers goroutines, which keeps each DID's events
+	// in order. Name identifies the scheduler in logs and metrics.
+	Scheduler string `hcl:"scheduler,optional"`
+	Workers   int    `hcl:"workers,optional"`
+	Name      string `hcl:"name,optional"`
+}
+
+type ArchiveConfig struct {
+	Path    string `hcl:"path"`
+	MaxSize string `hcl:"max_size,optional"`
+	MaxAge  string `hcl:"max_age,optional"`
+	Segment string `hcl:"segment,optional"`
+	maxSize uint64
+	maxAge  time.Duration
+	segment time.Duration
+}
+
 type AnalyzerConfig struct {
 	ID         string             `hcl:"id,label"`
 	Triggers   []string           `hcl:"triggers,optional"`
@@ -39,9 +81,152 @@ func readConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 	log.Debug("Configuration is %#v", config)
+	config.cursorInterval = defaultCursorInterval
+	if config.CursorInterval != "" {
+		if config.cursorInterval, err = time.ParseDuration(config.CursorInterval); err != nil {
+			return nil, fmt.Errorf("invalid cursor_interval: %w", err)
+		}
+	}
+	config.cursorRewind = defaultCursorRewind
+	if config.CursorRewind != "" {
+		if config.cursorRewind, err = time.ParseDuration(config.CursorRewind); err != nil {
+			return nil, fmt.Errorf("invalid cursor_rewind: %w", err)
+		}
+	}
+	if config.Jetstream == nil {
+		config.Jetstream = &JetstreamConfig{}
+	}
+	if len(config.Jetstream.Endpoints) == 0 {
+		config.Jetstream.Endpoints = defaultJetstreamEndpoints
+	}
+	switch config.Jetstream.Scheduler {
+	case "":
+		config.Jetstream.Scheduler = "sequential"
+	case "sequential", "parallel":
+	default:
+		return nil, fmt.Errorf("unknown jetstream scheduler %q", config.Jetstream.Scheduler)
+	}
+	if config.Jetstream.Workers <= 0 {
+		config.Jetstream.Workers = defaultSchedulerWorkers
+	}
+	if config.Jetstream.Name == "" {
+		config.Jetstream.Name = defaultSchedulerName
+	}
+	config.Jetstream.backoffMin = defaultBackoffMin
+	if config.Jetstream.BackoffMin != "" {
+		if config.Jetstream.backoffMin, err = time.ParseDuration(config.Jetstream.BackoffMin); err != nil {
+			return nil, fmt.Errorf("invalid jetstream backoff_min: %w", err)
+		}
+	}
+	config.Jetstream.backoffMax = defaultBackoffMax
+	if config.Jetstream.BackoffMax != "" {
+		if config.Jetstream.backoffMax, err = time.ParseDuration(config.Jetstream.BackoffMax); err != nil {
+			return nil, fmt.Errorf("invalid jetstream backoff_max: %w", err)
+		}
+	}
+	if ac := config.Archive; ac != nil {
+		if ac.MaxSize != "" {
+			if ac.maxSize, err = humanize.ParseBytes(ac.MaxSize); err != nil {
+				return nil, fmt.Errorf("invalid archive max_size: %w", err)
+			}
+		}
+		if ac.MaxAge != "" {
+			if ac.maxAge, err = time.ParseDuration(ac.MaxAge); err != nil {
+				return nil, fmt.Errorf("invalid archive max_age: %w", err)
+			}
+		} else if ac.maxSize == 0 {
+			ac.maxAge = defaultArchiveMaxAge
+		}
+		ac.segment = defaultArchiveSegment
+		if ac.Segment != "" {
+			if ac.segment, err = time.ParseDuration(ac.Segment); err != nil {
+				return nil, fmt.Errorf("invalid archive segment: %w", err)
+			}
+		}
+	}
+	if config.AppView == "" {
+		config.AppView = defaultAppView
+	}
 	for _, fc := range config.Feeds {
+		if fc.Overload == "" {
+			fc.Overload = string(OverloadBlock)
+		}
+		if !validOverloadPolicy(OverloadPolicy(fc.Overload)) {
+			return nil, fmt.Errorf("feed %s: unknown overload policy %q", fc.ID, fc.Overload)
+		}
+		if fc.Ranking != nil {
+			if err := fc.Ranking.parse(); err != nil {
+				return nil, fmt.Errorf("feed %s: %w", fc.ID, err)
+			}
+			if fc.Ranking.Ranked() && !fc.Engagement {
+				return nil, fmt.Errorf("feed %s: %s ranking needs engagement = true", fc.ID, fc.Ranking.Mode)
+			}
+		}
+		if fc.Admission != nil {
+			if err := fc.Admission.parse(); err != nil {
+				return nil, fmt.Errorf("feed %s: %w", fc.ID, err)
+			}
+			if !fc.Engagement {
+				return nil, fmt.Errorf("feed %s: admission needs engagement = true", fc.ID)
+			}
+		}
+		if fc.Curators != nil {
+			if err := fc.Curators.parse(); err != nil {
+				return nil, fmt.Errorf("feed %s: %w", fc.ID, err)
+			}
+		}
+		fc.tags = normalizeTags(fc.Hashtags)
+		if len(fc.MatchFields) == 0 {
+			fc.MatchFields = []string{fieldText}
+		}
+		for _, field := range fc.MatchFields {
+			if !slices.Contains(matchFieldNames, field) {
+				return nil, fmt.Errorf("feed %s: unknown match field %q", fc.ID, field)
+			}
+		}
+		for _, kind := range fc.ContentTypes {
+			if !slices.Contains(contentTypeNames, kind) {
+				return nil, fmt.Errorf("feed %s: unknown content type %q", fc.ID, kind)
+			}
+		}
+		if fc.UntaggedLanguage == "" {
+			fc.UntaggedLanguage = untaggedInclude
+		}
+		if !validUntaggedLanguage(fc.UntaggedLanguage) {
+			return nil, fmt.Errorf("feed %s: unknown untagged_language policy %q", fc.ID, fc.UntaggedLanguage)
+		}
+		if fc.Rule != nil {
+			if fc.MatchExpr != "" || fc.ForceExpr != "" || fc.MatchAnalyzer != nil || len(fc.Hashtags) > 0 || len(fc.Mentions) > 0 {
+				return nil, fmt.Errorf("feed %s: rule can't be combined with match_expr, force_expr, match_analyzer, hashtags or mentions", fc.ID)
+			}
+			if err := fc.Rule.compile(ruleAll, config.Analyzers); err != nil {
+				return nil, fmt.Errorf("feed %s: %w", fc.ID, err)
+			}
+		}
+		// compiled here rather than on first use, as posts are matched from
+		// several goroutines at once
+		if fc.MatchExpr != "" {
+			if fc.matcher, err = regexp.Compile("(?i)" + fc.MatchExpr); err != nil {
+				return nil, fmt.Errorf("feed %s: invalid match_expr: %w", fc.ID, err)
+			}
+		}
+		if fc.ForceExpr != "" {
+			if fc.forcer, err = regexp.Compile("(?i)" + fc.ForceExpr); err != nil {
+				return nil, fmt.Errorf("feed %s: invalid force_expr: %w", fc.ID, err)
+			}
+		}
+		if fc.MatchAnalyzer != nil {
+			fc.smatcher = NewTextAnalyzer([]string{}, fc.MatchAnalyzer.Patterns, fc.MatchAnalyzer.Threshold, true)
+		}
+		if fc.SpillPath == "" {
+			fc.SpillPath = fc.DB + ".spill"
+		}
 		fc.filters = map[string]*TextAnalyzer{}
 		for _, ac := range config.Analyzers {
+			// an analyzer the feed matches posts with can't also exclude them
+			if fc.Rule.usesAnalyzer(ac.ID) {
+				continue
+			}
 			fc.filters[ac.ID] = NewTextAnalyzer(ac.Triggers, ac.Patterns, ac.Threshold, ac.AnyTrigger)
 		}
 	}
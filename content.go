@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+
+	bsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+// The kinds of content a feed can be limited to.
+const (
+	contentImage = "image"
+	contentVideo = "video"
+	contentLink  = "link"
+)
+
+var contentTypeNames = []string{contentImage, contentVideo, contentLink}
+
+// contentModeVideo is the feed generator content mode telling apps to show
+// the feed as a video feed.
+const contentModeVideo = "app.bsky.feed.defs#contentModeVideo"
+
+// feedGeneratorRecord is a feed generator record with its content mode, which
+// the version of the lexicon we build against predates. It is only ever sent
+// as JSON, so the embedded record's CBOR encoding leaving it out doesn't
+// matter.
+type feedGeneratorRecord struct {
+	bsky.FeedGenerator
+	ContentMode string `json:"contentMode,omitempty"`
+}
+
+// hasContent reports whether the post has content of the given kind: images,
+// a video, or links in its text or as a link card.
+func (p *ParsedPost) hasContent(kind string) bool {
+	switch kind {
+	case contentImage:
+		return len(p.Images) > 0
+	case contentVideo:
+		return p.Video != nil
+	case contentLink:
+		return p.HasLink()
+	}
+	return false
+}
+
+// AcceptsContent reports whether the post has the content the feed is
+// limited to, by content_types and link_domains.
+func (feed *Feed) AcceptsContent(post *ParsedPost) bool {
+	if len(feed.ContentTypes) > 0 && !slices.ContainsFunc(feed.ContentTypes, post.hasContent) {
+		return false
+	}
+	if len(feed.LinkDomains) > 0 {
+		return slices.ContainsFunc(post.LinkDomains(), func(host string) bool {
+			return slices.ContainsFunc(feed.LinkDomains, func(want string) bool { return domainMatches(host, want) })
+		})
+	}
+	return true
+}
+
+// VideoOnly reports whether the feed only has posts with a video, so apps
+// can be told to show it as a video feed.
+func (feed *Feed) VideoOnly() bool {
+	return len(feed.ContentTypes) > 0 && !slices.ContainsFunc(feed.ContentTypes, func(kind string) bool {
+		return kind != contentVideo
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	curateInclude = "include"
+	curateRequire = "require"
+
+	defaultCuratorRefresh = 15 * time.Minute
+)
+
+// CuratorConfig lets trusted accounts pick posts for a feed by liking or
+// reposting them. With "include" their picks are added alongside the posts
+// that match, and with "require" only their picks that also match are.
+type CuratorConfig struct {
+	Dids    []string `hcl:"dids,optional"`
+	List    string   `hcl:"list,optional"`
+	Mode    string   `hcl:"mode,optional"`
+	Refresh string   `hcl:"refresh,optional"`
+	refresh time.Duration
+	members map[string]bool
+	sync.RWMutex
+}
+
+func (cc *CuratorConfig) parse() error {
+	var err error
+	switch cc.Mode {
+	case "":
+		cc.Mode = curateInclude
+	case curateInclude, curateRequire:
+	default:
+		return fmt.Errorf("unknown curators mode %q", cc.Mode)
+	}
+	if len(cc.Dids) == 0 && cc.List == "" {
+		return fmt.Errorf("curators needs dids or a list")
+	}
+	cc.refresh = defaultCuratorRefresh
+	if cc.Refresh != "" {
+		if cc.refresh, err = time.ParseDuration(cc.Refresh); err != nil {
+			return fmt.Errorf("invalid curators refresh: %w", err)
+		}
+	}
+	cc.setMembers(nil)
+	return nil
+}
+
+// setMembers makes the curators the configured DIDs plus those given.
+func (cc *CuratorConfig) setMembers(dids []string) {
+	members := make(map[string]bool, len(cc.Dids)+len(dids))
+	for _, did := range cc.Dids {
+		members[did] = true
+	}
+	for _, did := range dids {
+		members[did] = true
+	}
+	cc.Lock()
+	cc.members = members
+	cc.Unlock()
+}
+
+func (cc *CuratorConfig) IsCurator(did string) bool {
+	if cc == nil {
+		return false
+	}
+	cc.RLock()
+	defer cc.RUnlock()
+	return cc.members[did]
+}
+
+// listMembers fetches the DIDs on a Bluesky list from the AppView.
+func listMembers(ctx context.Context, list string) ([]string, error) {
+	var dids []string
+	cursor := ""
+	for {
+		out, err := apibsky.GraphGetList(ctx, appViewClient(), cursor, 100, list)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			if item.Subject != nil {
+				dids = append(dids, item.Subject.Did)
+			}
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Items) == 0 {
+			return dids, nil
+		}
+		cursor = *out.Cursor
+	}
+}
+
+// runCurators keeps the curators from the feed's list up to date.
+func (feed *Feed) runCurators(ctx context.Context) {
+	cc := feed.Curators
+	if cc == nil || cc.List == "" {
+		return
+	}
+	for {
+		dids, err := listMembers(ctx, cc.List)
+		if err != nil {
+			log.Error("Failed to fetch curators list", "feed", feed.ID, "list", cc.List, "error", err)
+		} else {
+			cc.setMembers(dids)
+			log.Info("Updated curators", "feed", feed.ID, "list", cc.List, "curators", len(dids)+len(cc.Dids))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cc.refresh):
+		}
+	}
+}
+
+// matchesAlone reports whether a post can join the feed just by matching,
+// rather than needing a curator to pick it. A feed with curators and nothing
+// to match on only has their picks.
+func (feed *Feed) matchesAlone() bool {
+	if feed.Curators == nil {
+		return true
+	}
+	return feed.Curators.Mode == curateInclude &&
+		(feed.MatchExpr != "" || feed.ForceExpr != "" || feed.MatchAnalyzer != nil || feed.Rule != nil ||
+			len(feed.Hashtags) > 0 || len(feed.Mentions) > 0)
+}
+
+// CurateHandler adds the post a curator liked or reposted to the feed. The
+// post is fetched, as a pick stands in for matching the post's text but not
+// for the feed's other checks, and when curators are required it has to
+// match too.
+func (feed *Feed) CurateHandler(job *WorkItem) (error, bool) {
+	e := job.payload.(*ParsedEngagement)
+	author, _, isPost := strings.Cut(strings.TrimPrefix(e.Subject, "at://"), "/app.bsky.feed.post/")
+	if !isPost || !feed.AcceptsAuthor(author) || feed.blocksOwner(author) {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(feed.curator.Context(), appViewTimeout)
+	defer cancel()
+	post, err := fetchPost(ctx, e.Subject)
+	if err != nil {
+		return fmt.Errorf("failed to fetch curated post: %w", err), false
+	}
+	if !feed.Accepts(post) || feed.Curators.Mode == curateRequire && !feed.Matches(post) {
+		return nil, false
+	}
+	p := &Post{
+		URI:       e.Subject,
+		CID:       e.SubjectCID,
+		IndexedAt: fmt.Sprintf("%d", time.Now().UnixMilli()),
+		Author:    author,
+	}
+	if post.IsReply() {
+		p.ReplyParent = &post.ReplyParent
+		p.ReplyRoot = &post.ReplyRoot
+	}
+	log.Debug("Curated post", "feed", feed.ID, "uri", e.Subject, "curator", e.Did)
+	feed.admitPost(p)
+	return nil, false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/client"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+	"gorm.io/gorm"
+)
+
+const (
+	jetstreamCursorService = "jetstream"
+	defaultCursorInterval  = 5 * time.Second
+	defaultCursorRewind    = 5 * time.Second
+	defaultCursorStart     = 10 * time.Minute
+)
+
+// resumeCursor works out where to start reading the source from. Each feed
+// database holds its own checkpoint, already rewound by the source, and we
+// resume from the oldest of them so that no feed misses events. When nothing
+// has been saved yet we start from a short while ago, as we always have,
+// which only makes sense for a jetstream; other sources return 0 to start
+// from their live position.
+func resumeCursor(feeds []*Feed, service string) int64 {
+	var cursor int64
+	if service == "" {
+		return cursor
+	}
+	for _, feed := range feeds {
+		if feed.db == nil {
+			continue
+		}
+		saved, err := loadCursor(feed.db, service)
+		if err != nil {
+			log.Error("Failed to load cursor", "feed", feed.ID, "error", err)
+			continue
+		}
+		if saved > 0 && (cursor == 0 || saved < cursor) {
+			cursor = saved
+		}
+	}
+	if cursor == 0 {
+		if service != jetstreamCursorService {
+			log.Info("No saved cursor, starting from live events", "service", service)
+			return 0
+		}
+		cursor = time.Now().Add(-defaultCursorStart).UnixMicro()
+		log.Info("No saved cursor, starting from default", "cursor", cursor)
+		return cursor
+	}
+	log.Info("Resuming from saved cursor", "service", service, "cursor", cursor)
+	return cursor
+}
+
+// checkpointCursor records cursor in every feed database, unless the source
+// has no cursor worth saving. It is saved through each feed's writer, after
+// the writes of the events it covers.
+func checkpointCursor(feeds []*Feed, service string, cursor int64) {
+	if service == "" || cursor == 0 {
+		return
+	}
+	for _, feed := range feeds {
+		if feed.db == nil {
+			continue
+		}
+		feed.ch <- func(db *gorm.DB) {
+			if err := saveCursor(db, service, cursor); err != nil {
+				log.Error("Failed to save cursor", "feed", feed.ID, "error", err)
+			}
+		}
+	}
+}
+
+// progress tracks the events still being processed, so that we only ever
+// checkpoint events that every feed has finished with. An event is in flight
+// from when its source reads it until the work queued for it is done.
+type progress struct {
+	inflight  map[int64]int
+	queued    map[*models.Event]*eventRef
+	highwater int64
+	sync.Mutex
+}
+
+// eventRef counts the work still to be done for one event.
+type eventRef struct {
+	p      *progress
+	timeUS int64
+	refs   atomic.Int32
+}
+
+// queue puts an event in flight as its source reads it, before a scheduler
+// that may hold it back for a while hands it to be handled.
+func (p *progress) queue(event *models.Event) *eventRef {
+	p.Lock()
+	defer p.Unlock()
+	if p.queued == nil {
+		p.queued = map[*models.Event]*eventRef{}
+	}
+	r := p.begin(event.TimeUS)
+	p.queued[event] = r
+	return r
+}
+
+// handle returns the ref for an event about to be handled, putting it in
+// flight now if it wasn't queued.
+func (p *progress) handle(event *models.Event) *eventRef {
+	p.Lock()
+	defer p.Unlock()
+	if r, ok := p.queued[event]; ok {
+		delete(p.queued, event)
+		return r
+	}
+	return p.begin(event.TimeUS)
+}
+
+// begin puts an event in flight until its ref is released, and must be
+// called with the lock held.
+func (p *progress) begin(timeUS int64) *eventRef {
+	if p.inflight == nil {
+		p.inflight = map[int64]int{}
+	}
+	p.inflight[timeUS]++
+	r := &eventRef{p: p, timeUS: timeUS}
+	r.refs.Store(1)
+	return r
+}
+
+// trackingScheduler puts each event in flight as the source hands it to the
+// next scheduler. A parallel scheduler queues each DID's events behind the
+// one being handled, so older events can still be waiting when newer ones
+// for other DIDs are done.
+type trackingScheduler struct {
+	next client.Scheduler
+	p    *progress
+}
+
+func (ts *trackingScheduler) AddWork(ctx context.Context, repo string, evt *models.Event) error {
+	ts.p.queue(evt)
+	if err := ts.next.AddWork(ctx, repo, evt); err != nil {
+		ts.p.handle(evt).release()
+		return err
+	}
+	return nil
+}
+
+func (ts *trackingScheduler) Shutdown() {
+	ts.next.Shutdown()
+}
+
+// hold keeps the event in flight until the returned func is called as well.
+func (r *eventRef) hold() func() {
+	r.refs.Add(1)
+	return r.release
+}
+
+func (r *eventRef) release() {
+	if r.refs.Add(-1) > 0 {
+		return
+	}
+	p := r.p
+	p.Lock()
+	defer p.Unlock()
+	if p.inflight[r.timeUS]--; p.inflight[r.timeUS] <= 0 {
+		delete(p.inflight, r.timeUS)
+	}
+	p.highwater = max(p.highwater, r.timeUS)
+}
+
+// Cursor returns the time up to which every event has been processed: just
+// before the oldest event still in flight, or the newest event processed if
+// there are none.
+func (p *progress) Cursor() int64 {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.inflight) == 0 {
+		return p.highwater
+	}
+	var oldest int64
+	for timeUS := range p.inflight {
+		if oldest == 0 || timeUS < oldest {
+			oldest = timeUS
+		}
+	}
+	return oldest - 1
+}
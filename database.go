@@ -8,6 +8,7 @@ import (
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Post struct {
@@ -16,11 +17,35 @@ type Post struct {
 	ReplyParent *string
 	ReplyRoot   *string
 	IndexedAt   string
+	Likes       int64 `gorm:"notNull;default:0"`
+	Reposts     int64 `gorm:"notNull;default:0"`
+	// State is empty for posts in the feed, or pending for posts held back
+	// until they have enough engagement.
+	State string `gorm:"index;notNull;default:''"`
+	// Hidden is set while the author's account is taken down, suspended or
+	// deactivated.
+	Hidden bool `gorm:"index;notNull;default:false"`
+	// Author is the DID of the account that wrote the post.
+	Author string `gorm:"index;notNull;default:''"`
+}
+
+// Engagement records a like or repost counted against a post in the feed, so
+// the count can be taken back when it is deleted.
+type Engagement struct {
+	URI     string `gorm:"primaryKey"`
+	Subject string `gorm:"index"`
 }
 
 type SubState struct {
-	Sservice string
-	Cursor   int
+	Sservice string `gorm:"primaryKey"`
+	Cursor   int64
+}
+
+// BackfillState holds the signature of the feed's matching config when it
+// was last backfilled from the archive, in its only row.
+type BackfillState struct {
+	ID        int `gorm:"primaryKey"`
+	Signature int64
 }
 
 func openDatabase(filename string) (*gorm.DB, error) {
@@ -30,13 +55,50 @@ func openDatabase(filename string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.AutoMigrate(&Post{}, &SubState{})
+	db.AutoMigrate(&Post{}, &SubState{}, &BackfillState{}, &Engagement{}, &OptIn{}, &Block{}, &NoUnauthenticated{}, &HiddenAuthor{})
+	// posts stored before they had an author column get it from their uri
+	db.Model(&Post{}).Where("author = ''").
+		Update("author", gorm.Expr("substr(uri, 6, instr(substr(uri, 6), '/') - 1)"))
 	return db, nil
 }
 
+// loadCursor returns the checkpointed cursor for service, or 0 if the feed
+// database has never recorded one.
+func loadCursor(db *gorm.DB, service string) (int64, error) {
+	var state SubState
+	res := db.Where("sservice = ?", service).Limit(1).Find(&state)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	return state.Cursor, nil
+}
+
+func saveCursor(db *gorm.DB, service string, cursor int64) error {
+	return db.Save(&SubState{Sservice: service, Cursor: cursor}).Error
+}
+
+// loadBackfillSignature returns the signature the feed was last backfilled
+// with, or 0 if it never has been.
+func loadBackfillSignature(db *gorm.DB) (int64, error) {
+	var state BackfillState
+	res := db.Limit(1).Find(&state)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	return state.Signature, nil
+}
+
+func saveBackfillSignature(db *gorm.DB, sig int64) error {
+	return db.Save(&BackfillState{ID: 1, Signature: sig}).Error
+}
+
 const writeBufferSize = 1024 * 1024
 
-func postWriter(ctx context.Context, cfg *Feed) (chan *Post, error) {
+// dbWrite is a change to a feed database. Writes are applied one at a time,
+// in the order they were queued, by the feed's postWriter.
+type dbWrite func(db *gorm.DB)
+
+func postWriter(ctx context.Context, cfg *Feed) (chan dbWrite, error) {
 	if cfg.db == nil {
 		db, err := openDatabase(cfg.DB)
 		if err != nil {
@@ -45,11 +107,18 @@ func postWriter(ctx context.Context, cfg *Feed) (chan *Post, error) {
 		cfg.db = db
 	}
 	log.Info("Starting database consumer", "feed", cfg.ID)
-	cfg.ch = make(chan *Post, writeBufferSize)
+	cfg.ch = make(chan dbWrite, writeBufferSize)
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
+				// finish what was queued before stopping, such as the
+				// final checkpoint
+				for len(cfg.ch) > 0 {
+					if write := <-cfg.ch; cfg.db != nil {
+						write(cfg.db)
+					}
+				}
 				if cfg.db != nil {
 					if rawdb, err := cfg.db.DB(); err == nil {
 						log.Warn("Stopping database consumer", "feed", cfg.ID)
@@ -57,9 +126,9 @@ func postWriter(ctx context.Context, cfg *Feed) (chan *Post, error) {
 					}
 				}
 				return
-			case p := <-cfg.ch:
+			case write := <-cfg.ch:
 				if cfg.db != nil {
-					cfg.db.Create(p)
+					write(cfg.db)
 				}
 			default:
 				time.Sleep(time.Millisecond)
@@ -68,3 +137,163 @@ func postWriter(ctx context.Context, cfg *Feed) (chan *Post, error) {
 	}()
 	return cfg.ch, nil
 }
+
+// writePost adds a post to the feed. An updated post may already be in the
+// feed, in which case it keeps its place but picks up the new content.
+func (feed *Feed) writePost(p *Post) {
+	feed.ch <- func(db *gorm.DB) {
+		db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "uri"}},
+			DoUpdates: clause.AssignmentColumns([]string{"c_id", "reply_parent", "reply_root"}),
+		}).Create(p)
+	}
+}
+
+// admitPost adds a post to the feed straight away, taking it out of any
+// pending state.
+func (feed *Feed) admitPost(p *Post) {
+	feed.ch <- func(db *gorm.DB) {
+		db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "uri"}},
+			DoUpdates: clause.AssignmentColumns([]string{"state"}),
+		}).Create(p)
+	}
+}
+
+// deletePost removes a post from the feed, if it is there, along with the
+// engagement counted against it.
+func (feed *Feed) deletePost(uri string) {
+	feed.ch <- func(db *gorm.DB) {
+		if n := removePost(db, uri); n > 0 {
+			n = feed.stats.Deleted.Add(n)
+			log.Debug("Deleted post", "feed", feed.ID, "uri", uri, "total_deleted", n)
+		}
+	}
+}
+
+// retractPost removes a post that was edited so that it no longer matches,
+// if it is in the feed.
+func (feed *Feed) retractPost(uri string) {
+	feed.ch <- func(db *gorm.DB) {
+		if n := removePost(db, uri); n > 0 {
+			n = feed.stats.Retracted.Add(n)
+			log.Debug("Retracted post", "feed", feed.ID, "uri", uri, "total_retracted", n)
+		}
+	}
+}
+
+// removePost deletes a post and the engagement counted against it,
+// returning how many posts were deleted.
+func removePost(db *gorm.DB, uri string) int64 {
+	res := db.Where("uri = ?", uri).Delete(&Post{})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return 0
+	}
+	db.Where("subject = ?", uri).Delete(&Engagement{})
+	return res.RowsAffected
+}
+
+// purgeAuthor removes every post by did from the feed, along with the
+// engagement counted against them, logging why for the record.
+func (feed *Feed) purgeAuthor(did, reason string) {
+	feed.ch <- func(db *gorm.DB) {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			posts := tx.Model(&Post{}).Select("uri").Where("author = ?", did)
+			if err := tx.Where("subject in (?)", posts).Delete(&Engagement{}).Error; err != nil {
+				return err
+			}
+			res := tx.Where("author = ?", did).Delete(&Post{})
+			if res.Error == nil && res.RowsAffected > 0 {
+				n := feed.stats.Deleted.Add(res.RowsAffected)
+				log.Info("Purged author's posts", "feed", feed.ID, "did", did, "reason", reason, "posts", res.RowsAffected, "total_deleted", n)
+			}
+			return res.Error
+		})
+		if err != nil {
+			log.Error("Failed to purge author's posts", "feed", feed.ID, "did", did, "reason", reason, "error", err)
+		}
+	}
+}
+
+// hideAuthor hides every post by did in the feed, or shows them again,
+// logging the account status that led to it for the record.
+func (feed *Feed) hideAuthor(did string, hidden bool, status string) {
+	feed.ch <- func(db *gorm.DB) {
+		res := db.Model(&Post{}).
+			Where("author = ? and hidden = ?", did, !hidden).
+			Update("hidden", hidden)
+		if res.Error != nil {
+			log.Error("Failed to update author's posts", "feed", feed.ID, "did", did, "status", status, "hidden", hidden, "error", res.Error)
+			return
+		}
+		if hidden {
+			// the author is only remembered while they have posts hidden,
+			// which may be from an earlier hide
+			var n int64
+			db.Model(&Post{}).Where("author = ? and hidden = ?", did, true).Limit(1).Count(&n)
+			feed.hidden.settle(db, did, did, n > 0)
+		}
+		if res.RowsAffected == 0 {
+			return
+		}
+		if hidden {
+			n := feed.stats.Hidden.Add(res.RowsAffected)
+			log.Info("Hid author's posts", "feed", feed.ID, "did", did, "status", status, "posts", res.RowsAffected, "total_hidden", n)
+		} else {
+			n := feed.stats.Restored.Add(res.RowsAffected)
+			log.Info("Restored author's posts", "feed", feed.ID, "did", did, "status", status, "posts", res.RowsAffected, "total_restored", n)
+		}
+	}
+}
+
+// addEngagement counts a like or repost against its subject, if the subject
+// is in the feed. Seeing the same like or repost again doesn't count twice.
+func (feed *Feed) addEngagement(e *ParsedEngagement) {
+	feed.ch <- func(db *gorm.DB) {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var n int64
+			if err := tx.Model(&Post{}).Where("uri = ?", e.Subject).Count(&n).Error; err != nil || n == 0 {
+				return err
+			}
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Engagement{URI: e.URI, Subject: e.Subject})
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			col := e.counter()
+			return tx.Model(&Post{}).Where("uri = ?", e.Subject).Update(col, gorm.Expr(col+" + 1")).Error
+		})
+		if err != nil {
+			log.Error("Failed to add engagement", "feed", feed.ID, "uri", e.URI, "error", err)
+		}
+	}
+}
+
+// removeEngagement takes back a like or repost, if it was counted.
+func (feed *Feed) removeEngagement(e *ParsedEngagement) {
+	feed.ch <- func(db *gorm.DB) {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var eng Engagement
+			res := tx.Where("uri = ?", e.URI).Limit(1).Find(&eng)
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			if err := tx.Delete(&eng).Error; err != nil {
+				return err
+			}
+			col := e.counter()
+			return tx.Model(&Post{}).Where("uri = ? and "+col+" > 0", eng.Subject).Update(col, gorm.Expr(col+" - 1")).Error
+		})
+		if err != nil {
+			log.Error("Failed to remove engagement", "feed", feed.ID, "uri", e.URI, "error", err)
+		}
+	}
+}
+
+// flush waits for the writes queued so far to be applied.
+func (feed *Feed) flush() {
+	done := make(chan struct{})
+	feed.ch <- func(db *gorm.DB) {
+		close(done)
+	}
+	<-done
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	likeCollection   = "app.bsky.feed.like"
+	repostCollection = "app.bsky.feed.repost"
+)
+
+// ParsedEngagement is a like, repost, follow or block event, decoded once
+// and shared by every feed. The subject is the post liked or reposted, or
+// the account followed or blocked. Deletes carry no record, so the subject
+// is only known for creates.
+type ParsedEngagement struct {
+	URI        string
+	Did        string
+	Collection string
+	Operation  string
+	Subject    string
+	SubjectCID string
+}
+
+func (e *ParsedEngagement) IsDelete() bool {
+	return e.Operation == models.CommitOperationDelete
+}
+
+// counter names the post column the engagement is counted in.
+func (e *ParsedEngagement) counter() string {
+	if e.Collection == repostCollection {
+		return "reposts"
+	}
+	return "likes"
+}
+
+// parseEngagement decodes a like, repost, follow or block commit event.
+func parseEngagement(event *models.Event) (*ParsedEngagement, error) {
+	e := &ParsedEngagement{
+		URI:        fmt.Sprintf("at://%s/%s/%s", event.Did, event.Commit.Collection, event.Commit.RKey),
+		Did:        event.Did,
+		Collection: event.Commit.Collection,
+		Operation:  event.Commit.Operation,
+	}
+	switch {
+	case e.IsDelete():
+	case e.Collection == likeCollection:
+		var like apibsky.FeedLike
+		if err := json.Unmarshal(event.Commit.Record, &like); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal like: %w", err)
+		}
+		if like.Subject != nil {
+			e.Subject = like.Subject.Uri
+			e.SubjectCID = like.Subject.Cid
+		}
+	case e.Collection == repostCollection:
+		var repost apibsky.FeedRepost
+		if err := json.Unmarshal(event.Commit.Record, &repost); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal repost: %w", err)
+		}
+		if repost.Subject != nil {
+			e.Subject = repost.Subject.Uri
+			e.SubjectCID = repost.Subject.Cid
+		}
+	case e.Collection == followCollection:
+		var follow apibsky.GraphFollow
+		if err := json.Unmarshal(event.Commit.Record, &follow); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal follow: %w", err)
+		}
+		e.Subject = follow.Subject
+	case e.Collection == blockCollection:
+		var block apibsky.GraphBlock
+		if err := json.Unmarshal(event.Commit.Record, &block); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal block: %w", err)
+		}
+		e.Subject = block.Subject
+	}
+	return e, nil
+}
+
+// HandleEngagement counts a like or repost against the post it is for, if
+// that post is in the feed, and hands those by curators on to be curated.
+// Likes and follows may also join their author to the feed, and blocks of
+// the feed owner keep them out.
+func (feed *Feed) HandleEngagement(e *ParsedEngagement) {
+	if e.Collection == blockCollection {
+		feed.handleBlock(e)
+		return
+	}
+	if feed.OptIn != nil {
+		feed.handleOptIn(e)
+	}
+	if e.Collection == followCollection {
+		return
+	}
+	if feed.curator != nil && feed.Curators.IsCurator(e.Did) &&
+		e.Operation == models.CommitOperationCreate && e.Subject != "" {
+		feed.curator.AddWork(e)
+	}
+	if !feed.Engagement {
+		return
+	}
+	switch {
+	case e.IsDelete():
+		feed.removeEngagement(e)
+	case e.Operation == models.CommitOperationCreate && e.Subject != "":
+		feed.addEngagement(e)
+	default:
+		log.Debug("Ignoring engagement", "feed", feed.ID, "uri", e.URI, "operation", e.Operation)
+	}
+}
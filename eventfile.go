@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Event files hold one jetstream event as JSON per line, and are zstd
+// compressed when the file name ends in .zst.
+
+const maxEventLine = 4 * 1024 * 1024
+
+// readEventFile calls fn with each event in the file in turn, returning the
+// number of events read.
+func readEventFile(ctx context.Context, path string, fn func(event *models.Event)) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".zst") {
+		dec, err := zstd.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	var count int
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxEventLine)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return count, nil
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var event models.Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			log.Warn("Skipping malformed event", "path", path, "error", err)
+			continue
+		}
+		fn(&event)
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// eventWriter appends events to an event file. It isn't safe for concurrent
+// use.
+type eventWriter struct {
+	f  *os.File
+	zw *zstd.Encoder
+	w  *bufio.Writer
+}
+
+func openEventWriter(path string) (*eventWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ew := &eventWriter{f: f}
+	if strings.HasSuffix(path, ".zst") {
+		// appending to a zstd file adds another frame, which readers
+		// handle just fine
+		if ew.zw, err = zstd.NewWriter(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		ew.w = bufio.NewWriter(ew.zw)
+	} else {
+		ew.w = bufio.NewWriter(f)
+	}
+	return ew, nil
+}
+
+func (ew *eventWriter) Write(event *models.Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ew.w.Write(b)
+	return ew.w.WriteByte('\n')
+}
+
+func (ew *eventWriter) Close() error {
+	err := ew.w.Flush()
+	if ew.zw != nil {
+		if zerr := ew.zw.Close(); err == nil {
+			err = zerr
+		}
+	}
+	if ferr := ew.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeTags puts hashtags in the form they are compared in, dropping
+// empty and repeated tags. A tag loses its leading #, and is case folded in
+// Unicode normal form, so that #Café, #CAFÉ and #café written with a
+// combining accent are all the same tag.
+func normalizeTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	fold := cases.Fold()
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimLeft(tag, "#＃")
+		tag = norm.NFC.String(fold.String(norm.NFD.String(tag)))
+		if tag != "" && !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// HasTag reports whether the post carries any of the normalized tags, in
+// its tag facets or its tags field.
+func (p *ParsedPost) HasTag(tags []string) bool {
+	return slices.ContainsFunc(p.Tags, func(tag string) bool {
+		return slices.Contains(tags, tag)
+	})
+}
+
+// HasMention reports whether the post mentions any of the DIDs, in its
+// mention facets.
+func (p *ParsedPost) HasMention(dids []string) bool {
+	return slices.ContainsFunc(p.Mentions, func(did string) bool {
+		return slices.Contains(dids, did)
+	})
+}
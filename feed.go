@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"regexp"
+	"slices"
+	"sync/atomic"
 	"time"
 
-	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/jetstream/pkg/models"
 	"github.com/charmbracelet/log"
 	"github.com/gin-gonic/gin"
@@ -14,26 +17,84 @@ import (
 )
 
 type Feed struct {
-	ID               string          `hcl:"id,label"`
-	Name             string          `hcl:"name"`
-	PinnedURI        string          `hcl:"pinned_uri,optional"`
-	Host             string          `hcl:"host,optional"`
-	Port             int             `hcl:"port"`
-	MatchExpr        string          `hcl:"match_expr,optional"`
-	MatchAnalyzer    *AnalyzerConfig `hcl:"match_analyzer,block"`
-	ForceExpr        string          `hcl:"force_expr,optional"`
-	IncludeReplies   bool            `hcl:"include_replies,optional"`
-	DB               string          `hcl:"database"`
+	ID               string           `hcl:"id,label"`
+	Name             string           `hcl:"name"`
+	PinnedURI        string           `hcl:"pinned_uri,optional"`
+	Host             string           `hcl:"host,optional"`
+	Port             int              `hcl:"port"`
+	MatchExpr        string           `hcl:"match_expr,optional"`
+	MatchAnalyzer    *AnalyzerConfig  `hcl:"match_analyzer,block"`
+	ForceExpr        string           `hcl:"force_expr,optional"`
+	IncludeReplies   bool             `hcl:"include_replies,optional"`
+	Authors          []string         `hcl:"authors,optional"`
+	Engagement       bool             `hcl:"engagement,optional"`
+	Ranking          *RankingConfig   `hcl:"ranking,block"`
+	Admission        *AdmissionConfig `hcl:"admission,block"`
+	Curators         *CuratorConfig   `hcl:"curators,block"`
+	OptIn            *OptInConfig     `hcl:"opt_in,block"`
+	DB               string           `hcl:"database"`
+	Overload         string           `hcl:"overload,optional"`
+	SpillPath        string           `hcl:"spill_path,optional"`
 	matcher          *regexp.Regexp
 	forcer           *regexp.Regexp
 	smatcher         *TextAnalyzer
 	db               *gorm.DB
-	ch               chan *Post
+	ch               chan dbWrite
+	stats            FeedStats
+	rankings         rankCache
+	blocked          authorSet
+	noUnauth         authorSet
+	hidden           authorSet
 	PublishConfig    *PublishConfig `hcl:"publish,block"`
 	ExclusionFilters []string       `hcl:"exclusion_filters,optional"`
 	filters          map[string]*TextAnalyzer
 	worker           *Worker
+	curator          *Worker
+	stopBackfill     func()
 	r                *gin.Engine
+
+	AllowedSelfLabels        []string `hcl:"allowed_self_labels,optional"`
+	ExcludedSelfLabels       []string `hcl:"excluded_self_labels,optional"`
+	RespectNoUnauthenticated bool     `hcl:"respect_no_unauthenticated,optional"`
+
+	Rule *RuleConfig `hcl:"rule,block"`
+
+	Languages         []string `hcl:"languages,optional"`
+	ExcludedLanguages []string `hcl:"excluded_languages,optional"`
+	UntaggedLanguage  string   `hcl:"untagged_language,optional"`
+	DetectLanguage    bool     `hcl:"detect_language,optional"`
+
+	Hashtags []string `hcl:"hashtags,optional"`
+	Mentions []string `hcl:"mentions,optional"`
+	tags     []string
+
+	MatchFields []string `hcl:"match_fields,optional"`
+
+	ContentTypes []string `hcl:"content_types,optional"`
+	LinkDomains  []string `hcl:"link_domains,optional"`
+
+	IgnoreBlocks bool `hcl:"ignore_blocks,optional"`
+}
+
+// FeedStats holds counters for a feed, reported by its stats endpoint.
+type FeedStats struct {
+	Deleted   atomic.Int64
+	Retracted atomic.Int64
+	Admitted  atomic.Int64
+	Expired   atomic.Int64
+	Hidden    atomic.Int64
+	Restored  atomic.Int64
+}
+
+func (s *FeedStats) Snapshot() map[string]int64 {
+	return map[string]int64{
+		"deleted":   s.Deleted.Load(),
+		"retracted": s.Retracted.Load(),
+		"admitted":  s.Admitted.Load(),
+		"expired":   s.Expired.Load(),
+		"hidden":    s.Hidden.Load(),
+		"restored":  s.Restored.Load(),
+	}
 }
 
 type Pattern struct {
@@ -52,6 +113,94 @@ func (feed *Feed) GetLocalHostUrl(baseDid string) string {
 	return url
 }
 
+// WantedCollections lists the collections the feed needs events for.
+func (feed *Feed) WantedCollections() []string {
+	collections := []string{"app.bsky.feed.post"}
+	if !feed.IgnoreBlocks {
+		collections = append(collections, blockCollection)
+	}
+	if feed.Engagement || feed.Curators != nil {
+		collections = append(collections, likeCollection, repostCollection)
+	} else if feed.OptIn != nil && feed.OptIn.JoinPost != "" {
+		collections = append(collections, likeCollection)
+	}
+	if feed.OptIn != nil && feed.OptIn.Follow {
+		collections = append(collections, followCollection)
+	}
+	if feed.RespectNoUnauthenticated {
+		collections = append(collections, profileCollection)
+	}
+	return collections
+}
+
+// WantedDids lists the accounts the feed needs events from, or nil if it
+// needs events from everyone.
+func (feed *Feed) WantedDids() []string {
+	// likes and reposts of the authors' posts, and the likes and follows
+	// that authors join with, can come from anyone
+	if len(feed.Authors) == 0 || feed.Engagement || feed.OptIn != nil {
+		return nil
+	}
+	if cc := feed.Curators; cc != nil {
+		if cc.List != "" {
+			return nil
+		}
+		return append(slices.Clone(feed.Authors), cc.Dids...)
+	}
+	return feed.Authors
+}
+
+// MatchSignature summarises the config that decides which posts the feed
+// matches, so we can tell when it has changed.
+func (feed *Feed) MatchSignature() int64 {
+	b, _ := json.Marshal([]any{
+		feed.MatchExpr,
+		feed.ForceExpr,
+		feed.MatchAnalyzer,
+		feed.IncludeReplies,
+		feed.Authors,
+		feed.ExclusionFilters,
+		feed.curatorSignature(),
+		feed.optInSignature(),
+		feed.AllowedSelfLabels,
+		feed.ExcludedSelfLabels,
+		feed.RespectNoUnauthenticated,
+		feed.Rule,
+		feed.Languages,
+		feed.ExcludedLanguages,
+		feed.UntaggedLanguage,
+		feed.DetectLanguage,
+		feed.Hashtags,
+		feed.Mentions,
+		feed.MatchFields,
+		feed.ContentTypes,
+		feed.LinkDomains,
+		feed.IgnoreBlocks,
+	})
+	h := fnv.New64a()
+	h.Write(b)
+	return int64(h.Sum64())
+}
+
+func (feed *Feed) curatorSignature() any {
+	if cc := feed.Curators; cc != nil {
+		return []any{cc.Dids, cc.List, cc.Mode}
+	}
+	return nil
+}
+
+func (feed *Feed) optInSignature() any {
+	if oc := feed.OptIn; oc != nil {
+		return []any{oc.JoinPost, oc.Follow}
+	}
+	return nil
+}
+
+// AcceptsAuthor reports whether posts by did may appear in the feed.
+func (feed *Feed) AcceptsAuthor(did string) bool {
+	return len(feed.Authors) == 0 || slices.Contains(feed.Authors, did)
+}
+
 func (feed *Feed) ShouldFilter(postText string) bool {
 	for name, analyzer := range feed.filters {
 		if score, filter := analyzer.Score(postText); filter {
@@ -62,92 +211,244 @@ func (feed *Feed) ShouldFilter(postText string) bool {
 	return false
 }
 
-func (feed *Feed) Matches(postText string, isReply bool) bool {
-	if feed.ForceExpr != "" {
-		if feed.forcer == nil {
-			feed.forcer = regexp.MustCompile("(?i)" + feed.ForceExpr)
-		}
-		if feed.forcer.MatchString(postText) {
-			return true
-		}
+// excluded reports whether any of the fields should be filtered out.
+func (feed *Feed) excluded(fields *postFields) bool {
+	if len(feed.filters) == 0 {
+		return false
 	}
-	if feed.MatchExpr != "" {
-		if feed.matcher == nil {
-			feed.matcher = regexp.MustCompile("(?i)" + feed.MatchExpr)
+	_, ok := matchIn(fields, feed.ShouldFilter)
+	return ok
+}
+
+// Accepts reports whether the post passes the feed's checks other than
+// matching its text: who wrote it, and its labels, languages and content.
+func (feed *Feed) Accepts(post *ParsedPost) bool {
+	if !feed.AcceptsAuthor(post.Did) || feed.blocksOwner(post.Did) || feed.hidesLoggedOut(post.Did) {
+		return false
+	}
+	if !feed.AcceptsSelfLabels(post.SelfLabels) || !feed.AcceptsLanguages(post) || !feed.AcceptsContent(post) {
+		return false
+	}
+	return feed.OptIn == nil || feed.OptIn.IsMember(post.Did)
+}
+
+func (feed *Feed) Matches(post *ParsedPost) bool {
+	_, matches := feed.Match(post, feed.fetchQuote)
+	return matches
+}
+
+// Match reports whether the post matches the feed, and what matched it: the
+// field of the post, or hashtag, mention or rule. Matching looks at the
+// fields in match_fields, fetching the quoted post with quote, if it isn't
+// nil, once nothing cheaper has settled it.
+func (feed *Feed) Match(post *ParsedPost, quote quoteFunc) (string, bool) {
+	isReply := post.IsReply()
+	if !feed.Accepts(post) {
+		return "", false
+	}
+	fields := post.Fields(feed.MatchFields, quote)
+	if feed.Rule != nil {
+		if feed.Rule.Matches(post, fields) && !feed.excluded(fields) {
+			return "rule", true
 		}
-		if feed.matcher.MatchString(postText) && (!isReply || (isReply && feed.IncludeReplies)) {
-			return !feed.ShouldFilter(postText)
+		return "", false
+	}
+	if feed.forcer != nil {
+		if field, ok := matchIn(fields, feed.forcer.MatchString); ok {
+			return field, true
 		}
-		return false
 	}
-	if feed.MatchAnalyzer != nil {
-		if feed.smatcher == nil {
-			feed.smatcher = NewTextAnalyzer([]string{}, feed.MatchAnalyzer.Patterns, feed.MatchAnalyzer.Threshold, true)
+	if feed.MatchExpr != "" || len(feed.Hashtags) > 0 || len(feed.Mentions) > 0 {
+		if isReply && !feed.IncludeReplies {
+			return "", false
+		}
+		field, matched := "", false
+		switch {
+		case post.HasTag(feed.tags):
+			field, matched = "hashtag", true
+		case post.HasMention(feed.Mentions):
+			field, matched = "mention", true
+		case feed.matcher != nil:
+			field, matched = matchIn(fields, feed.matcher.MatchString)
 		}
-		if _, matches := feed.smatcher.Score(postText); !matches {
-			return false
+		if matched && !feed.excluded(fields) {
+			return field, true
 		}
+		return "", false
+	}
+	if feed.smatcher != nil {
+		return matchIn(fields, func(text string) bool {
+			_, matches := feed.smatcher.Score(text)
+			return matches
+		})
 	}
 
-	return true
+	return "", true
 }
 
 func (feed *Feed) StartProcessing(logger *log.Logger) {
 	feed.worker = NewWorker(
 		feed.ID+"-worker",
-		feed.PostHandler,
+		feed.EventHandler,
 		3, // number of retries
-		3, // max concurrency
+		1, // max concurrency, as a post's delete must follow its create
 		false,
 		dummyBackoffFunc,
 		logger,
 	)
+	err := feed.worker.SetOverload(OverloadPolicy(feed.Overload), feed.SpillPath, decodeFeedWork, func(payload any) bool {
+		// dropping a delete, or an edit that may retract the post, would
+		// leave the post in the feed, and dropping a block or a change of
+		// account status or profile would leave the author's posts as they
+		// were
+		work := payload.(*feedWork)
+		if work.Account != nil || work.Profile != nil {
+			return true
+		}
+		if e := work.Engagement; e != nil {
+			return e.IsDelete() || e.Collection == blockCollection
+		}
+		return work.Post.IsDelete() || work.Post.Operation == models.CommitOperationUpdate
+	})
+	if err != nil {
+		log.Error("Failed to set overload policy, blocking instead", "feed", feed.ID, "error", err)
+		feed.worker.overload = OverloadBlock
+	}
 	feed.worker.Start()
+	if feed.Curators != nil {
+		feed.curator = NewWorker(
+			feed.ID+"-curator",
+			feed.CurateHandler,
+			3, // number of retries
+			1, // max concurrency
+			false,
+			dummyBackoffFunc,
+			logger,
+		)
+		// curated posts may need fetching, which shouldn't hold up events
+		feed.curator.SetOverload(OverloadDropNewest, "", nil, nil)
+		feed.curator.Start()
+	}
+}
+
+// Stats returns the feed's counters along with those of its worker queue.
+func (feed *Feed) Stats() map[string]int64 {
+	stats := feed.stats.Snapshot()
+	if feed.worker != nil {
+		stats["dropped"] = feed.worker.Dropped()
+		stats["spilled"] = feed.worker.Spilled()
+		stats["queued"] = int64(feed.worker.Backlog())
+	}
+	if feed.OptIn != nil {
+		stats["opted_in"] = int64(feed.OptIn.Members())
+	}
+	stats["blocked"] = int64(feed.blocked.Len())
+	return stats
 }
 
 func (feed *Feed) Stop() {
+	if feed.stopBackfill != nil {
+		feed.stopBackfill()
+		feed.stopBackfill = nil
+	}
 	if feed.worker != nil {
 		feed.worker.Stop()
 	}
+	if feed.curator != nil {
+		feed.curator.Stop()
+	}
 }
 
-func (feed *Feed) PostHandler(job *WorkItem) (error, bool) {
-	event := job.payload.(*models.Event)
+// feedWork is an event queued for the feed's worker: a post, a like,
+// repost, follow or block, or a change of account status or profile, so
+// that they are handled in turn and under the same overload policy.
+type feedWork struct {
+	Post       *ParsedPost                            `json:",omitempty"`
+	Engagement *ParsedEngagement                      `json:",omitempty"`
+	Account    *comatproto.SyncSubscribeRepos_Account `json:",omitempty"`
+	Profile    *ParsedProfile                         `json:",omitempty"`
+}
 
-	var post apibsky.FeedPost
-	if err := json.Unmarshal(event.Commit.Record, &post); err != nil {
-		return fmt.Errorf("failed to unmarshal post: %w", err), true // no retry if this fails
+// decodeFeedWork turns spilled work back into a payload.
+func decodeFeedWork(b []byte) (any, error) {
+	var work feedWork
+	if err := json.Unmarshal(b, &work); err != nil {
+		return nil, err
+	}
+	if work.Post == nil && work.Engagement == nil && work.Account == nil && work.Profile == nil {
+		return nil, fmt.Errorf("no work in spilled line")
 	}
+	return &work, nil
+}
 
-	if feed.Matches(post.Text, post.Reply != nil) {
-		uri := fmt.Sprintf("at://%s/%s/%s", event.Did, event.Commit.Collection, event.Commit.RKey)
-		feed.worker.logger.Debug("Post match", "feed", feed.ID, "uri", uri)
-		var reply_parent = ""
-		var reply_root = ""
+func (feed *Feed) EventHandler(job *WorkItem) (error, bool) {
+	work := job.payload.(*feedWork)
+	switch {
+	case work.Account != nil:
+		feed.HandleAccount(work.Account)
+		return nil, false
+	case work.Profile != nil:
+		feed.HandleProfile(work.Profile)
+		return nil, false
+	case work.Engagement != nil:
+		feed.HandleEngagement(work.Engagement)
+		return nil, false
+	}
+	return feed.HandlePost(work.Post, time.Now(), feed.fetchQuote)
+}
+
+// HandlePost applies a post event to the feed, indexing a matching post at
+// indexedAt. Quoted posts are fetched with quote, which backfills leave nil.
+func (feed *Feed) HandlePost(post *ParsedPost, indexedAt time.Time, quote quoteFunc) (error, bool) {
+	if post.IsDelete() {
+		return feed.DeleteHandler(post)
+	}
+	if !feed.AcceptsAuthor(post.Did) {
+		return nil, false
+	}
+
+	field, matches := feed.Match(post, quote)
+	if matches && feed.matchesAlone() {
+		log.Debug("Post match", "feed", feed.ID, "uri", post.URI, "field", field)
 		// log.Printf("post time = %d", event.TimeUS / 1000)
 		p := &Post{
-			URI:       uri,
-			CID:       event.Commit.CID,
-			IndexedAt: fmt.Sprintf("%d", time.Now().UnixMilli()),
+			URI:       post.URI,
+			CID:       post.CID,
+			IndexedAt: fmt.Sprintf("%d", indexedAt.UnixMilli()),
+			Author:    post.Did,
 		}
-		if post.Reply != nil {
-			reply_parent = post.Reply.Parent.Uri
-			reply_root = post.Reply.Root.Uri
+		if feed.Admission != nil {
+			p.State = postPending
+		}
+		if post.IsReply() {
+			reply_parent := post.ReplyParent
+			reply_root := post.ReplyRoot
 			p.ReplyParent = &reply_parent
 			p.ReplyRoot = &reply_root
 		}
 		// log.Printf("Writing post")
-		feed.ch <- p
+		feed.writePost(p)
 		if cfg.Debug {
 			fmt.Printf(
-				"[%s] %v |(%s)| %s\n",
+				"[%s] %v |(%s)| <%s> %s\n",
 				feed.ID,
-				time.UnixMicro(event.TimeUS).Format("15:04:05"),
-				event.Did,
+				time.UnixMicro(post.TimeUS).Format("15:04:05"),
+				post.Did,
+				field,
 				post.Text,
 			)
 		}
+	} else if !matches && post.Operation == models.CommitOperationUpdate {
+		// the post was edited so that it no longer matches, so retract it
+		// in case it was previously included
+		feed.retractPost(post.URI)
 	}
 
 	return nil, false
 }
+
+// DeleteHandler removes a post from the feed when its author deletes it.
+func (feed *Feed) DeleteHandler(post *ParsedPost) (error, bool) {
+	feed.deletePost(post.URI)
+	return nil, false
+}
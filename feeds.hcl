@@ -9,7 +9,9 @@ feed "ducks" {
 
     match_expr = "\\b(ducks|quack|canard)\\b"
 
-    force_expr = "\\b(#ducks)\\b"
+    # unlike the force_expr this replaced, hashtag matches follow
+    # include_replies and exclusion_filters
+    hashtags = ["ducks"]
 
     include_replies = true
 
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// The fields of a post that matching can look at.
+const (
+	fieldText            = "text"
+	fieldAlt             = "alt"
+	fieldLinkTitle       = "link_title"
+	fieldLinkDescription = "link_description"
+	fieldLinkURI         = "link_uri"
+	fieldQuote           = "quote"
+)
+
+var matchFieldNames = []string{fieldText, fieldAlt, fieldLinkTitle, fieldLinkDescription, fieldLinkURI, fieldQuote}
+
+// postField is the text of one field of a post.
+type postField struct {
+	name string
+	text string
+}
+
+// postFields is the text of the fields of a post that a feed matches on.
+// The quoted post is only fetched once nothing else has matched.
+type postFields struct {
+	fields   []postField
+	quoteURI string
+	fetch    quoteFunc
+	fetched  bool
+	quote    string
+}
+
+// quoteFunc returns the text of the post at uri, or "" if it can't be had.
+type quoteFunc func(uri string) string
+
+// Fields returns the text of each of the named fields the post has. A post
+// may have several alt texts, one for each image, and several link URIs,
+// from its link card and the links in its text. The quoted post is fetched
+// with quote, if the quote field is named and quote isn't nil.
+func (p *ParsedPost) Fields(names []string, quote quoteFunc) *postFields {
+	pf := &postFields{}
+	add := func(name, text string) {
+		if text != "" && slices.Contains(names, name) {
+			pf.fields = append(pf.fields, postField{name: name, text: text})
+		}
+	}
+	add(fieldText, p.Text)
+	for _, img := range p.Images {
+		add(fieldAlt, img.Alt)
+	}
+	if p.Video != nil {
+		add(fieldAlt, p.Video.Alt)
+	}
+	if p.External != nil {
+		add(fieldLinkTitle, p.External.Title)
+		add(fieldLinkDescription, p.External.Description)
+		add(fieldLinkURI, p.External.URI)
+	}
+	for _, link := range p.Links {
+		add(fieldLinkURI, link)
+	}
+	if p.QuoteURI != "" && quote != nil && slices.Contains(names, fieldQuote) {
+		pf.quoteURI = p.QuoteURI
+		pf.fetch = quote
+	}
+	return pf
+}
+
+// quoteText returns the text of the quoted post, fetching it the first time.
+func (pf *postFields) quoteText() string {
+	if pf.quoteURI == "" {
+		return ""
+	}
+	if !pf.fetched {
+		pf.quote = pf.fetch(pf.quoteURI)
+		pf.fetched = true
+	}
+	return pf.quote
+}
+
+const (
+	// quoteCacheSize is how many quoted posts we remember the text of, as
+	// the same post is often quoted many times over.
+	quoteCacheSize = 10000
+	// maxQuoteFetches is how many quoted posts are fetched from the AppView
+	// at once, across every feed.
+	maxQuoteFetches = 4
+)
+
+// quoteFetcher fetches quoted posts from the AppView for every feed,
+// remembering the text of the last few, and fetching each post only once
+// at a time.
+type quoteFetcher struct {
+	texts    *lru.Cache[string, string]
+	fetching map[string]chan struct{}
+	slots    chan struct{}
+	sync.Mutex
+}
+
+var quotes = newQuoteFetcher()
+
+func newQuoteFetcher() *quoteFetcher {
+	texts, _ := lru.New[string, string](quoteCacheSize)
+	return &quoteFetcher{
+		texts:    texts,
+		fetching: map[string]chan struct{}{},
+		slots:    make(chan struct{}, maxQuoteFetches),
+	}
+}
+
+// text returns the text of the post at uri, or "" if it can't be fetched
+// before ctx is done.
+func (qf *quoteFetcher) text(ctx context.Context, uri string) string {
+	for {
+		qf.Lock()
+		if text, ok := qf.texts.Get(uri); ok {
+			qf.Unlock()
+			return text
+		}
+		wait, busy := qf.fetching[uri]
+		if !busy {
+			qf.fetching[uri] = make(chan struct{})
+			qf.Unlock()
+			return qf.fetch(ctx, uri)
+		}
+		qf.Unlock()
+		// another feed is fetching it
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-wait:
+		}
+	}
+}
+
+func (qf *quoteFetcher) fetch(ctx context.Context, uri string) string {
+	defer func() {
+		qf.Lock()
+		close(qf.fetching[uri])
+		delete(qf.fetching, uri)
+		qf.Unlock()
+	}()
+	select {
+	case qf.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ""
+	}
+	defer func() { <-qf.slots }()
+
+	fetchCtx, cancel := context.WithTimeout(ctx, appViewTimeout)
+	defer cancel()
+	quoted, err := fetchPost(fetchCtx, uri)
+	if err != nil {
+		log.Debug("Failed to fetch quoted post", "uri", uri, "error", err)
+		// a post that is gone, or an AppView that is too slow, isn't asked
+		// again, but a fetch cut short by stopping is
+		if ctx.Err() == nil {
+			qf.texts.Add(uri, "")
+		}
+		return ""
+	}
+	qf.texts.Add(uri, quoted.Text)
+	return quoted.Text
+}
+
+// fetchQuote fetches the text of a quoted post for the quote field, giving
+// up once the feed stops.
+func (feed *Feed) fetchQuote(uri string) string {
+	return quotes.text(feed.worker.Context(), uri)
+}
+
+// matchIn returns the name of the first field whose text matches. The
+// quoted post is only fetched if no other field does.
+func matchIn(fields *postFields, match func(string) bool) (string, bool) {
+	for _, f := range fields.fields {
+		if match(f.text) {
+			return f.name, true
+		}
+	}
+	if text := fields.quoteText(); text != "" && match(text) {
+		return fieldQuote, true
+	}
+	return "", false
+}
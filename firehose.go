@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/data"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/events"
+	"github.com/bluesky-social/indigo/events/schedulers/sequential"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/jetstream/pkg/client"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultFirehoseRelay  = "wss://bsky.network"
+	firehoseCursorService = "firehose"
+
+	// how far apart in time the seqs we remember are, and how many we keep,
+	// which covers a little over six minutes
+	firehoseSeqInterval = 100 * time.Millisecond
+	firehoseSeqHistory  = 4096
+)
+
+// seqMark records the seq of an event seen at a given time.
+type seqMark struct {
+	timeUS int64
+	seq    int64
+}
+
+// firehoseSource reads com.atproto.sync.subscribeRepos from a relay, turning
+// the records in each commit into the events a jetstream would have sent.
+// The relay can't filter for us, so events are filtered here by the same
+// collections and DIDs we would ask a jetstream for.
+type firehoseSource struct {
+	relay       string
+	backoffMin  time.Duration
+	backoffMax  time.Duration
+	scheduler   client.Scheduler
+	dialer      *websocket.Dialer
+	collections []string
+	dids        map[string]bool
+	eventsRead  atomic.Int64
+	lastSeq     int64
+	marks       []seqMark
+	sync.Mutex
+}
+
+func newFirehoseSource(relay string, cfg *Config, scheduler client.Scheduler) *firehoseSource {
+	s := &firehoseSource{
+		relay:      relay,
+		backoffMin: cfg.Jetstream.backoffMin,
+		backoffMax: cfg.Jetstream.backoffMax,
+		scheduler:  scheduler,
+		dialer:     websocket.DefaultDialer,
+	}
+	s.setFilter(cfg.Feeds)
+	return s
+}
+
+func (s *firehoseSource) setFilter(feeds []*Feed) {
+	collections, dids := subscriptionFilter(feeds)
+	s.collections = collections
+	s.dids = nil
+	if len(dids) > 0 {
+		s.dids = make(map[string]bool, len(dids))
+		for _, did := range dids {
+			s.dids[did] = true
+		}
+	}
+}
+
+func (s *firehoseSource) Reconfigure(cfg *Config) error {
+	s.Lock()
+	defer s.Unlock()
+	s.backoffMin = cfg.Jetstream.backoffMin
+	s.backoffMax = cfg.Jetstream.backoffMax
+	s.setFilter(cfg.Feeds)
+	return nil
+}
+
+func (s *firehoseSource) CursorService() string {
+	return firehoseCursorService
+}
+
+// Checkpoint finds the seq of the last event we remember seeing at or before
+// the rewound time, as the firehose cursor is a seq rather than a time.
+func (s *firehoseSource) Checkpoint(handled int64, rewind time.Duration) int64 {
+	if handled == 0 {
+		return 0
+	}
+	target := handled - rewind.Microseconds()
+	s.Lock()
+	defer s.Unlock()
+	if len(s.marks) == 0 {
+		return 0
+	}
+	i := sort.Search(len(s.marks), func(i int) bool {
+		return s.marks[i].timeUS > target
+	})
+	// if we don't remember back that far, the oldest seq is the best we have
+	if i == 0 {
+		return s.marks[0].seq
+	}
+	return s.marks[i-1].seq
+}
+
+// mark remembers the seq of an event, at most once every
+// firehoseSeqInterval, dropping the oldest once there are too many.
+func (s *firehoseSource) mark(timeUS, seq int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastSeq = seq
+	if n := len(s.marks); n > 0 && timeUS-s.marks[n-1].timeUS < firehoseSeqInterval.Microseconds() {
+		return
+	}
+	if len(s.marks) >= firehoseSeqHistory {
+		s.marks = slices.Delete(s.marks, 0, len(s.marks)-firehoseSeqHistory+1)
+	}
+	s.marks = append(s.marks, seqMark{timeUS: timeUS, seq: seq})
+}
+
+// Run reads from the relay until ctx is cancelled, starting at cursor, or at
+// the live position if cursor is 0. After a failure, resume is asked for the
+// seq to continue from.
+func (s *firehoseSource) Run(ctx context.Context, cursor int64, resume func() int64) {
+	attempt := 0
+	for ctx.Err() == nil {
+		log.Info("Connecting to firehose", "relay", s.relay, "cursor", cursor)
+		before := s.eventsRead.Load()
+		err := s.connectAndRead(ctx, cursor)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if s.eventsRead.Load() > before {
+			attempt = 0
+		}
+		if next := resume(); next > 0 {
+			cursor = next
+		} else {
+			// nothing has been handled yet, so carry on from what we read
+			s.Lock()
+			if s.lastSeq > 0 {
+				cursor = s.lastSeq
+			}
+			s.Unlock()
+		}
+		s.Lock()
+		delay := backoffDelay(s.backoffMin, s.backoffMax, attempt)
+		s.Unlock()
+		attempt++
+		log.Warn("Firehose connection failed", "relay", s.relay, "error", err, "retry_in", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s *firehoseSource) connectAndRead(ctx context.Context, cursor int64) error {
+	u, err := url.Parse(s.relay)
+	if err != nil {
+		return fmt.Errorf("failed to parse relay %q: %w", s.relay, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/xrpc/com.atproto.sync.subscribeRepos"
+	if cursor > 0 {
+		q := u.Query()
+		q.Set("cursor", strconv.FormatInt(cursor, 10))
+		u.RawQuery = q.Encode()
+	}
+
+	header := http.Header{}
+	header.Set("User-Agent", "jetstream-feeds")
+	conn, _, err := s.dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return err
+	}
+
+	callbacks := &events.RepoStreamCallbacks{
+		RepoCommit: func(evt *comatproto.SyncSubscribeRepos_Commit) error {
+			return s.handleCommit(ctx, evt)
+		},
+		RepoAccount: func(evt *comatproto.SyncSubscribeRepos_Account) error {
+			return s.handleAccount(ctx, evt)
+		},
+		RepoIdentity: func(evt *comatproto.SyncSubscribeRepos_Identity) error {
+			return s.handleIdentity(ctx, evt)
+		},
+	}
+	// the stream closes the connection itself when ctx is cancelled
+	err = events.HandleRepoStream(ctx, conn, sequential.NewScheduler("firehose", callbacks.EventHandler))
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// wanted reports whether events from did are wanted, and must be called with
+// the lock held.
+func (s *firehoseSource) wanted(did string) bool {
+	return s.dids == nil || s.dids[did]
+}
+
+func (s *firehoseSource) handleCommit(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Commit) error {
+	s.eventsRead.Add(1)
+	timeUS := firehoseTime(evt.Time)
+	defer s.mark(timeUS, evt.Seq)
+
+	s.Lock()
+	wanted := s.wanted(evt.Repo)
+	collections := s.collections
+	s.Unlock()
+	if !wanted {
+		return nil
+	}
+	if evt.TooBig {
+		log.Warn("Skipping commit too big for the firehose", "did", evt.Repo, "seq", evt.Seq)
+		return nil
+	}
+
+	var r *repo.Repo
+	for _, op := range evt.Ops {
+		collection, rkey, _ := strings.Cut(op.Path, "/")
+		if collections != nil && !slices.Contains(collections, collection) {
+			continue
+		}
+		commit := &models.Commit{
+			Rev:        evt.Rev,
+			Operation:  op.Action,
+			Collection: collection,
+			RKey:       rkey,
+		}
+		if op.Action != models.CommitOperationDelete {
+			// the blocks are only read once a commit has an op we want
+			if r == nil {
+				var err error
+				if r, err = repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks)); err != nil {
+					log.Warn("Skipping commit with unreadable blocks", "did", evt.Repo, "seq", evt.Seq, "error", err)
+					return nil
+				}
+			}
+			rcid, raw, err := r.GetRecordBytes(ctx, op.Path)
+			if err != nil {
+				log.Warn("Skipping missing record", "did", evt.Repo, "path", op.Path, "error", err)
+				continue
+			}
+			rec, err := data.UnmarshalCBOR(*raw)
+			if err != nil {
+				log.Warn("Skipping undecodable record", "did", evt.Repo, "path", op.Path, "error", err)
+				continue
+			}
+			commit.Record, err = json.Marshal(rec)
+			if err != nil {
+				log.Warn("Skipping unencodable record", "did", evt.Repo, "path", op.Path, "error", err)
+				continue
+			}
+			commit.CID = rcid.String()
+		}
+
+		event := &models.Event{
+			Did:    evt.Repo,
+			TimeUS: timeUS,
+			Kind:   models.EventKindCommit,
+			Commit: commit,
+		}
+		if err := s.scheduler.AddWork(ctx, event.Did, event); err != nil {
+			return fmt.Errorf("failed to add work to scheduler: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *firehoseSource) handleAccount(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Account) error {
+	s.eventsRead.Add(1)
+	timeUS := firehoseTime(evt.Time)
+	defer s.mark(timeUS, evt.Seq)
+	s.Lock()
+	wanted := s.wanted(evt.Did)
+	s.Unlock()
+	if !wanted {
+		return nil
+	}
+	return s.scheduler.AddWork(ctx, evt.Did, &models.Event{
+		Did:     evt.Did,
+		TimeUS:  timeUS,
+		Kind:    models.EventKindAccount,
+		Account: evt,
+	})
+}
+
+func (s *firehoseSource) handleIdentity(ctx context.Context, evt *comatproto.SyncSubscribeRepos_Identity) error {
+	s.eventsRead.Add(1)
+	timeUS := firehoseTime(evt.Time)
+	defer s.mark(timeUS, evt.Seq)
+	s.Lock()
+	wanted := s.wanted(evt.Did)
+	s.Unlock()
+	if !wanted {
+		return nil
+	}
+	return s.scheduler.AddWork(ctx, evt.Did, &models.Event{
+		Did:      evt.Did,
+		TimeUS:   timeUS,
+		Kind:     models.EventKindIdentity,
+		Identity: evt,
+	})
+}
+
+// firehoseTime converts the time a relay broadcast an event into the
+// microseconds a jetstream event carries, falling back to now.
+func firehoseTime(t string) int64 {
+	if dt, err := syntax.ParseDatetimeLenient(t); err == nil {
+		return dt.Time().UnixMicro()
+	}
+	return time.Now().UnixMicro()
+}
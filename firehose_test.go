@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/events"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+// testCommitBlocks builds a signed repo for did holding the given records,
+// returning its commit CID and its blocks as CAR bytes, as a relay sends
+// them, along with the path and CID of each record.
+func testCommitBlocks(t *testing.T, did string, records map[string]repo.CborMarshaler) (cid.Cid, []byte, map[string]cid.Cid) {
+	t.Helper()
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	r := repo.NewRepo(ctx, did, bs)
+	cids := map[string]cid.Cid{}
+	for nsid, rec := range records {
+		c, rkey, err := r.CreateRecord(ctx, nsid, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids[nsid+"/"+rkey] = c
+	}
+	root, _, err := r.Commit(ctx, func(context.Context, string, []byte) ([]byte, error) {
+		return []byte("signature"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	header, err := cbor.DumpObject(&car.CarHeader{Roots: []cid.Cid{root}, Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := carutil.LdWrite(&buf, header); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for c := range keys {
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := carutil.LdWrite(&buf, c.Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, buf.Bytes(), cids
+}
+
+// testFrame encodes a subscribeRepos message of the given type.
+func testFrame(t *testing.T, msgType string, body cbg.CBORMarshaler) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	header := events.EventHeader{Op: events.EvtKindMessage, MsgType: msgType}
+	if err := header.MarshalCBOR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := body.MarshalCBOR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFirehoseSource(t *testing.T) {
+	const did = "did:plc:author"
+	root, blocks, cids := testCommitBlocks(t, did, map[string]repo.CborMarshaler{
+		"app.bsky.feed.post": &apibsky.FeedPost{Text: "ducks on the pond", CreatedAt: "2026-10-18T08:00:00Z"},
+		// not wanted by any feed, so it shouldn't come through
+		"app.bsky.feed.like": &apibsky.FeedLike{
+			Subject:   &comatproto.RepoStrongRef{Uri: "at://did:plc:other/app.bsky.feed.post/3k", Cid: "bafyreib"},
+			CreatedAt: "2026-10-18T08:00:00Z",
+		},
+	})
+	var ops []*comatproto.SyncSubscribeRepos_RepoOp
+	var postPath string
+	for path, c := range cids {
+		link := lexutil.LexLink(c)
+		ops = append(ops, &comatproto.SyncSubscribeRepos_RepoOp{Action: "create", Path: path, Cid: &link})
+		if strings.HasPrefix(path, "app.bsky.feed.post/") {
+			postPath = path
+		}
+	}
+	status := "takendown"
+	frames := [][]byte{
+		testFrame(t, "#commit", &comatproto.SyncSubscribeRepos_Commit{
+			Seq:    101,
+			Repo:   did,
+			Commit: lexutil.LexLink(root),
+			Rev:    "3kabc",
+			Blocks: blocks,
+			Ops:    ops,
+			Blobs:  []lexutil.LexLink{},
+			Time:   "2026-10-18T08:00:01.000Z",
+		}),
+		testFrame(t, "#commit", &comatproto.SyncSubscribeRepos_Commit{
+			Seq:    102,
+			Repo:   did,
+			Commit: lexutil.LexLink(root),
+			Rev:    "3kabd",
+			Blocks: []byte{},
+			Ops:    []*comatproto.SyncSubscribeRepos_RepoOp{{Action: "delete", Path: postPath}},
+			Blobs:  []lexutil.LexLink{},
+			Time:   "2026-10-18T08:00:02.000Z",
+		}),
+		testFrame(t, "#account", &comatproto.SyncSubscribeRepos_Account{
+			Seq:    103,
+			Did:    did,
+			Active: false,
+			Status: &status,
+			Time:   "2026-10-18T08:00:03.000Z",
+		}),
+	}
+
+	cursors := make(chan string, 1)
+	release := make(chan struct{})
+	var upgrader websocket.Upgrader
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/com.atproto.sync.subscribeRepos" {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		cursors <- r.URL.Query().Get("cursor")
+		for _, frame := range frames {
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				return
+			}
+		}
+		<-release
+	}))
+	defer relay.Close()
+	defer close(release)
+
+	cfg := &Config{
+		Jetstream: &JetstreamConfig{backoffMin: time.Second, backoffMax: time.Second},
+		Feeds:     []*Feed{{ID: "t", MatchExpr: "ducks"}},
+	}
+	rs := &recordScheduler{events: make(chan *models.Event, 10)}
+	src := newFirehoseSource("ws"+strings.TrimPrefix(relay.URL, "http"), cfg, rs)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Run(ctx, 0, func() int64 { return 0 })
+
+	select {
+	case cursor := <-cursors:
+		if cursor != "" {
+			t.Errorf("got cursor %q, want none to start from the live position", cursor)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection to stand-in relay")
+	}
+	var got []*models.Event
+	for range 3 {
+		select {
+		case event := <-rs.events:
+			got = append(got, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d events, want 3", len(got))
+		}
+	}
+
+	_, rkey, _ := strings.Cut(postPath, "/")
+	create := got[0]
+	if create.Did != did || create.Kind != models.EventKindCommit || create.Commit == nil {
+		t.Fatalf("got %+v, want a commit from %s", create, did)
+	}
+	if c := create.Commit; c.Operation != models.CommitOperationCreate || c.Collection != "app.bsky.feed.post" ||
+		c.RKey != rkey || c.CID != cids[postPath].String() || c.Rev != "3kabc" {
+		t.Errorf("got commit %+v, want a create of %s with CID %s", c, postPath, cids[postPath])
+	}
+	post, err := parsePost(create)
+	if err != nil {
+		t.Fatalf("created post doesn't parse: %v", err)
+	}
+	if post.Text != "ducks on the pond" {
+		t.Errorf("got post text %q, want %q", post.Text, "ducks on the pond")
+	}
+	if want := time.Date(2026, 10, 18, 8, 0, 1, 0, time.UTC).UnixMicro(); create.TimeUS != want {
+		t.Errorf("got time %d, want %d", create.TimeUS, want)
+	}
+
+	del := got[1]
+	if c := del.Commit; c == nil || c.Operation != models.CommitOperationDelete || c.RKey != rkey || c.Record != nil {
+		t.Errorf("got %+v, want a delete of %s", del.Commit, postPath)
+	}
+
+	acct := got[2]
+	if acct.Kind != models.EventKindAccount || acct.Account == nil || acct.Account.Active || *acct.Account.Status != status {
+		t.Errorf("got %+v, want a takendown account event", acct)
+	}
+
+	// the checkpoint for a time is the seq of the last event at or before it
+	if seq := src.Checkpoint(del.TimeUS, 0); seq != 102 {
+		t.Errorf("got checkpoint seq %d, want 102", seq)
+	}
+	var rec map[string]any
+	if err := json.Unmarshal(create.Commit.Record, &rec); err != nil || rec["$type"] != "app.bsky.feed.post" {
+		t.Errorf("got record %s, want a post with its $type", create.Commit.Record)
+	}
+}
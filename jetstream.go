@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/client"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+var defaultJetstreamEndpoints = []string{
+	"wss://jetstream2.us-east.bsky.network/subscribe",
+	"wss://jetstream1.us-east.bsky.network/subscribe",
+	"wss://jetstream1.us-west.bsky.network/subscribe",
+	"wss://jetstream2.us-west.bsky.network/subscribe",
+}
+
+const (
+	defaultBackoffMin = 1 * time.Second
+	defaultBackoffMax = 2 * time.Minute
+
+	defaultSchedulerName    = "jetstream-feeds"
+	defaultSchedulerWorkers = 8
+
+	// limits jetstream places on an options update
+	maxWantedCollections = 100
+	maxWantedDids        = 10000
+)
+
+// subscriberMessage is a message sent by us to the jetstream server.
+type subscriberMessage struct {
+	Type    string             `json:"type"`
+	Payload *subscriberOptions `json:"payload"`
+}
+
+type subscriberOptions struct {
+	WantedCollections   []string `json:"wantedCollections"`
+	WantedDids          []string `json:"wantedDids"`
+	MaxMessageSizeBytes int      `json:"maxMessageSizeBytes"`
+}
+
+// subscriptionFilter works out the collections and DIDs to ask the jetstream
+// for, so that we only receive events some feed can use. DIDs are only
+// filtered on if every feed is restricted to a set of accounts.
+func subscriptionFilter(feeds []*Feed) ([]string, []string) {
+	var collections, dids []string
+	restricted := len(feeds) > 0
+	for _, feed := range feeds {
+		for _, col := range feed.WantedCollections() {
+			if !slices.Contains(collections, col) {
+				collections = append(collections, col)
+			}
+		}
+		wanted := feed.WantedDids()
+		if wanted == nil {
+			restricted = false
+		}
+		for _, did := range wanted {
+			if !slices.Contains(dids, did) {
+				dids = append(dids, did)
+			}
+		}
+	}
+	if !restricted || len(dids) > maxWantedDids {
+		dids = nil
+	}
+	if len(collections) > maxWantedCollections {
+		collections = nil
+	}
+	slices.Sort(collections)
+	slices.Sort(dids)
+	return collections, dids
+}
+
+// jetstreamSource reads events from one of a list of jetstream endpoints,
+// moving on to the next whenever the connection fails.
+type jetstreamSource struct {
+	endpoints  []string
+	backoffMin time.Duration
+	backoffMax time.Duration
+	scheduler  client.Scheduler
+	dialer     *websocket.Dialer
+	decoder    *zstd.Decoder
+	current    int
+	eventsRead atomic.Int64
+	options    subscriberOptions
+	conn       *websocket.Conn
+	sync.Mutex
+}
+
+func newJetstreamSource(cfg *Config, scheduler client.Scheduler) (*jetstreamSource, error) {
+	jc := cfg.Jetstream
+	collections, dids := subscriptionFilter(cfg.Feeds)
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(models.ZSTDDictionary))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	return &jetstreamSource{
+		endpoints:  jc.Endpoints,
+		backoffMin: jc.backoffMin,
+		backoffMax: jc.backoffMax,
+		scheduler:  scheduler,
+		dialer:     websocket.DefaultDialer,
+		decoder:    dec,
+		options: subscriberOptions{
+			WantedCollections: collections,
+			WantedDids:        dids,
+		},
+	}, nil
+}
+
+// Reconfigure applies a reloaded config. The filter is sent to the server
+// straight away if we are connected, while new endpoints and backoff take
+// effect the next time we connect.
+func (s *jetstreamSource) Reconfigure(cfg *Config) error {
+	jc := cfg.Jetstream
+	collections, dids := subscriptionFilter(cfg.Feeds)
+	s.Lock()
+	defer s.Unlock()
+	if !slices.Equal(s.endpoints, jc.Endpoints) {
+		s.endpoints = jc.Endpoints
+		s.current = 0
+	}
+	s.backoffMin = jc.backoffMin
+	s.backoffMax = jc.backoffMax
+	if slices.Equal(s.options.WantedCollections, collections) && slices.Equal(s.options.WantedDids, dids) {
+		return nil
+	}
+	s.options.WantedCollections = collections
+	s.options.WantedDids = dids
+	if s.conn == nil {
+		return nil
+	}
+	log.Info("Updating jetstream subscription", "collections", collections, "dids", len(dids))
+	return s.sendOptions()
+}
+
+func (s *jetstreamSource) CursorService() string {
+	return jetstreamCursorService
+}
+
+// Checkpoint rewinds the time of the last event handled, as the jetstream
+// cursor is itself a time.
+func (s *jetstreamSource) Checkpoint(handled int64, rewind time.Duration) int64 {
+	if handled == 0 {
+		return 0
+	}
+	return handled - rewind.Microseconds()
+}
+
+// sendOptions writes the current filter to the connection, and must be
+// called with the lock held.
+func (s *jetstreamSource) sendOptions() error {
+	return s.conn.WriteJSON(&subscriberMessage{
+		Type:    "options_update",
+		Payload: &s.options,
+	})
+}
+
+func (s *jetstreamSource) backoff(attempt int) time.Duration {
+	return backoffDelay(s.backoffMin, s.backoffMax, attempt)
+}
+
+// backoffDelay returns an exponential delay for the given number of failed
+// attempts, with jitter so that many clients don't retry in lockstep.
+func backoffDelay(min, max time.Duration, attempt int) time.Duration {
+	delay := max
+	if attempt < 32 {
+		if d := min << attempt; d > 0 && d < max {
+			delay = d
+		}
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Run reads from the jetstream until ctx is cancelled, starting at cursor.
+// After a failure, resume is asked for the cursor to continue from, so that
+// it carries over to the next endpoint.
+func (s *jetstreamSource) Run(ctx context.Context, cursor int64, resume func() int64) {
+	attempt := 0
+	for ctx.Err() == nil {
+		s.Lock()
+		endpoint := s.endpoints[s.current%len(s.endpoints)]
+		s.Unlock()
+
+		log.Info("Connecting to jetstream", "endpoint", endpoint, "cursor", cursor)
+		before := s.eventsRead.Load()
+		err := s.connectAndRead(ctx, endpoint, cursor)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a connection that delivered events was healthy, so start the
+		// backoff again from the bottom
+		if s.eventsRead.Load() > before {
+			attempt = 0
+		}
+		if next := resume(); next > 0 {
+			cursor = next
+		}
+		s.Lock()
+		s.current = (s.current + 1) % len(s.endpoints)
+		next := s.endpoints[s.current]
+		delay := s.backoff(attempt)
+		s.Unlock()
+		attempt++
+		log.Warn("Jetstream connection failed", "endpoint", endpoint, "error", err, "next_endpoint", next, "retry_in", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s *jetstreamSource) connectAndRead(ctx context.Context, endpoint string, cursor int64) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to parse endpoint %q: %w", endpoint, err)
+	}
+	// the filter is sent as our first message rather than in the url, as the
+	// list of DIDs can be far longer than a url allows
+	q := u.Query()
+	q.Set("cursor", strconv.FormatInt(cursor, 10))
+	q.Set("requireHello", "true")
+	u.RawQuery = q.Encode()
+
+	header := http.Header{}
+	header.Set("User-Agent", "jetstream-feeds")
+	header.Set("Socket-Encoding", "zstd")
+
+	conn, _, err := s.dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s.Lock()
+	s.conn = conn
+	err = s.sendOptions()
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		s.conn = nil
+		s.Unlock()
+	}()
+	if err != nil {
+		return fmt.Errorf("failed to send subscriber options: %w", err)
+	}
+
+	// closing the connection is the only way to interrupt a blocked read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+		s.eventsRead.Add(1)
+
+		msg, err = s.decoder.DecodeAll(msg, nil)
+		if err != nil {
+			return fmt.Errorf("failed to decompress message: %w", err)
+		}
+
+		var event models.Event
+		if err := json.Unmarshal(msg, &event); err != nil {
+			return fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+
+		if err := s.scheduler.AddWork(ctx, event.Did, &event); err != nil {
+			return fmt.Errorf("failed to add work to scheduler: %w", err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// recordScheduler hands the events it is given to a channel, remembering
+// the time of the last one as handled.
+type recordScheduler struct {
+	events  chan *models.Event
+	handled atomic.Int64
+}
+
+func (rs *recordScheduler) AddWork(ctx context.Context, repo string, evt *models.Event) error {
+	rs.events <- evt
+	rs.handled.Store(evt.TimeUS)
+	return nil
+}
+
+func (rs *recordScheduler) Shutdown() {}
+
+// jetstreamStandIn is a local jetstream endpoint that sends canned events to
+// each connection, then hangs up if hangUp is set.
+type jetstreamStandIn struct {
+	*httptest.Server
+	events  []*models.Event
+	hangUp  bool
+	conns   chan jetstreamConn
+	release chan struct{}
+}
+
+// jetstreamConn is what a stand-in saw of one connection.
+type jetstreamConn struct {
+	at      time.Time
+	cursor  int64
+	options subscriberMessage
+}
+
+func newJetstreamStandIn(t *testing.T, hangUp bool, events ...*models.Event) *jetstreamStandIn {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(models.ZSTDDictionary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := &jetstreamStandIn{
+		events:  events,
+		hangUp:  hangUp,
+		conns:   make(chan jetstreamConn, 10),
+		release: make(chan struct{}),
+	}
+	var upgrader websocket.Upgrader
+	js.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		seen := jetstreamConn{at: time.Now()}
+		seen.cursor, _ = strconv.ParseInt(r.URL.Query().Get("cursor"), 10, 64)
+		if err := conn.ReadJSON(&seen.options); err != nil {
+			t.Errorf("failed to read subscriber options: %v", err)
+			return
+		}
+		js.conns <- seen
+		for _, event := range js.events {
+			b, _ := json.Marshal(event)
+			if err := conn.WriteMessage(websocket.BinaryMessage, enc.EncodeAll(b, nil)); err != nil {
+				return
+			}
+		}
+		if !js.hangUp {
+			<-js.release
+		}
+	}))
+	t.Cleanup(func() {
+		close(js.release)
+		js.Close()
+	})
+	return js
+}
+
+func (js *jetstreamStandIn) endpoint() string {
+	return "ws" + strings.TrimPrefix(js.URL, "http") + "/subscribe"
+}
+
+func (js *jetstreamStandIn) nextConn(t *testing.T) jetstreamConn {
+	t.Helper()
+	select {
+	case c := <-js.conns:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection to stand-in jetstream")
+	}
+	return jetstreamConn{}
+}
+
+func testPostEvent(timeUS int64) *models.Event {
+	return &models.Event{
+		Did:    "did:plc:a",
+		TimeUS: timeUS,
+		Kind:   models.EventKindCommit,
+		Commit: &models.Commit{
+			Operation:  models.CommitOperationCreate,
+			Collection: "app.bsky.feed.post",
+			RKey:       strconv.FormatInt(timeUS, 10),
+			Record:     json.RawMessage(`{"text":"ducks"}`),
+		},
+	}
+}
+
+func TestJetstreamSourceFailover(t *testing.T) {
+	first := newJetstreamStandIn(t, true, testPostEvent(100), testPostEvent(200))
+	second := newJetstreamStandIn(t, false, testPostEvent(300))
+
+	cfg := &Config{
+		Jetstream: &JetstreamConfig{
+			Endpoints:  []string{first.endpoint(), second.endpoint()},
+			backoffMin: 200 * time.Millisecond,
+			backoffMax: time.Second,
+		},
+		Feeds: []*Feed{{ID: "t", MatchExpr: "ducks"}},
+	}
+	rs := &recordScheduler{events: make(chan *models.Event, 10)}
+	src, err := newJetstreamSource(cfg, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Run(ctx, 50, func() int64 {
+		return src.Checkpoint(rs.handled.Load(), time.Microsecond)
+	})
+
+	c := first.nextConn(t)
+	firstAt := c.at
+	if c.cursor != 50 {
+		t.Errorf("first endpoint got cursor %d, want 50", c.cursor)
+	}
+	if c.options.Type != "options_update" || len(c.options.Payload.WantedCollections) == 0 {
+		t.Errorf("first endpoint got options %+v, want the subscription filter", c.options)
+	}
+	for _, want := range []int64{100, 200} {
+		select {
+		case event := <-rs.events:
+			if event.TimeUS != want {
+				t.Fatalf("got event at %d, want %d", event.TimeUS, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event at %d", want)
+		}
+	}
+
+	// the first endpoint hangs up after its events, so we should move on to
+	// the second after backing off, carrying on from the last event handled
+	c = second.nextConn(t)
+	if c.cursor != 199 {
+		t.Errorf("second endpoint got cursor %d, want 199", c.cursor)
+	}
+	if gap := c.at.Sub(firstAt); gap < 100*time.Millisecond {
+		t.Errorf("switched endpoints after %v, want a backoff of at least 100ms", gap)
+	}
+	select {
+	case event := <-rs.events:
+		if event.TimeUS != 300 {
+			t.Errorf("got event at %d from second endpoint, want 300", event.TimeUS)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event from second endpoint")
+	}
+	select {
+	case c := <-first.conns:
+		t.Errorf("reconnected to the first endpoint at %v", c.at)
+	default:
+	}
+}
+
+func TestJetstreamSourceBackoff(t *testing.T) {
+	// an endpoint that hangs up straight away, so every attempt fails
+	failing := newJetstreamStandIn(t, true)
+	cfg := &Config{
+		Jetstream: &JetstreamConfig{
+			Endpoints:  []string{failing.endpoint()},
+			backoffMin: 40 * time.Millisecond,
+			backoffMax: 160 * time.Millisecond,
+		},
+	}
+	src, err := newJetstreamSource(cfg, &recordScheduler{events: make(chan *models.Event)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Run(ctx, 0, func() int64 { return 0 })
+
+	// each delay is between half and all of min doubled per attempt, up to max
+	last := failing.nextConn(t).at
+	for attempt, want := range []time.Duration{40, 80, 160, 160} {
+		want *= time.Millisecond
+		at := failing.nextConn(t).at
+		gap := at.Sub(last)
+		if gap < want/2 {
+			t.Errorf("attempt %d came after %v, want at least %v", attempt, gap, want/2)
+		}
+		if gap > want+100*time.Millisecond {
+			t.Errorf("attempt %d came after %v, want about %v at most", attempt, gap, want)
+		}
+		last = at
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	min, max := time.Second, 10*time.Second
+	for attempt, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		want *= time.Second
+		for range 100 {
+			d := backoffDelay(min, max, attempt)
+			if d < want/2 || d > want {
+				t.Fatalf("attempt %d: got %v, want between %v and %v", attempt, d, want/2, want)
+			}
+		}
+	}
+	if d := backoffDelay(min, max, 1000); d < max/2 || d > max {
+		t.Errorf("attempt 1000: got %v, want between %v and %v", d, max/2, max)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	profileCollection = "app.bsky.actor.profile"
+
+	// noUnauthenticatedLabel is the profile self-label by which an author
+	// asks not to be shown to logged out users.
+	noUnauthenticatedLabel = "!no-unauthenticated"
+)
+
+// defaultExcludedSelfLabels are the self-labels marking adult content, which
+// general audience feeds leave out unless told otherwise.
+var defaultExcludedSelfLabels = []string{"porn", "sexual", "nudity", "graphic-media"}
+
+// NoUnauthenticated is a profile carrying the !no-unauthenticated label.
+type NoUnauthenticated struct {
+	URI string `gorm:"primaryKey"`
+	Did string `gorm:"index"`
+}
+
+// ParsedProfile is a profile event, decoded once and shared by every feed.
+type ParsedProfile struct {
+	URI               string
+	Did               string
+	Operation         string
+	NoUnauthenticated bool
+}
+
+func parseProfile(event *models.Event) (*ParsedProfile, error) {
+	p := &ParsedProfile{
+		URI:       fmt.Sprintf("at://%s/%s/%s", event.Did, event.Commit.Collection, event.Commit.RKey),
+		Did:       event.Did,
+		Operation: event.Commit.Operation,
+	}
+	if p.Operation == models.CommitOperationDelete {
+		return p, nil
+	}
+	var profile apibsky.ActorProfile
+	if err := json.Unmarshal(event.Commit.Record, &profile); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal profile: %w", err)
+	}
+	if profile.Labels != nil {
+		p.NoUnauthenticated = slices.Contains(selfLabelValues(profile.Labels.LabelDefs_SelfLabels), noUnauthenticatedLabel)
+	}
+	return p, nil
+}
+
+func selfLabelValues(labels *comatproto.LabelDefs_SelfLabels) []string {
+	if labels == nil {
+		return nil
+	}
+	var values []string
+	for _, label := range labels.Values {
+		if label != nil {
+			values = append(values, label.Val)
+		}
+	}
+	return values
+}
+
+// AcceptsSelfLabels reports whether a post with the given self-labels may
+// appear in the feed. Labels that are excluded are left out unless they are
+// also allowed.
+func (feed *Feed) AcceptsSelfLabels(labels []string) bool {
+	excluded := feed.ExcludedSelfLabels
+	if excluded == nil {
+		excluded = defaultExcludedSelfLabels
+	}
+	for _, label := range labels {
+		if slices.Contains(excluded, label) && !slices.Contains(feed.AllowedSelfLabels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// hidesLoggedOut reports whether did is kept out of the feed for asking not
+// to be shown to logged out users.
+func (feed *Feed) hidesLoggedOut(did string) bool {
+	return feed.RespectNoUnauthenticated && feed.noUnauth.Has(did)
+}
+
+// HandleProfile tracks which authors have asked not to be shown to logged
+// out users, for feeds that respect it, and removes their posts.
+func (feed *Feed) HandleProfile(p *ParsedProfile) {
+	if !feed.RespectNoUnauthenticated {
+		return
+	}
+	if p.NoUnauthenticated {
+		if _, joined := feed.noUnauth.add(feed, p.URI, p.Did); joined {
+			log.Info("Author asked not to be shown logged out, removing their posts", "feed", feed.ID, "did", p.Did)
+			feed.purgeAuthor(p.Did, "no-unauthenticated")
+		}
+		return
+	}
+	if did, ok, _ := feed.noUnauth.remove(feed, p.URI); ok {
+		log.Info("Author may be shown logged out again", "feed", feed.ID, "did", did)
+	}
+}
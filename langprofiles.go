@@ -0,0 +1,105 @@
+package main
+
+// langSamples is everyday text in each Latin script language the detector
+// knows, from which its trigram profiles are built. Languages written in
+// their own script are told apart by script instead.
+var langSamples = map[string]string{
+	"en": `I went to the pond this morning and there were so many ducks, more than I have ever seen there.
+The weather was lovely and the sun was out, so we stayed for a while and watched them swim around.
+Does anyone know what kind of bird this is? It has a green head and a white ring around its neck.
+We should have brought some bread, but I have heard that it is not good for them, so we brought seeds instead.
+Thank you all for the kind words about my photos, it really means a lot to me.
+What are you doing this weekend? I think I will go for a walk by the river if it does not rain.
+This is the best thing I have read all week, you should all take a look at it when you have the time.
+They said that the new park would be open by the end of the year, but nothing has happened yet.
+My friends and I were talking about how much things have changed since we were young.
+I would like to thank everyone who came out yesterday, it was great to see you all there.
+Just finished reading a book about the history of the city and it was much better than I expected.
+If you want to learn something new, there is no better time than now to get started with it.
+People keep asking me where I took these pictures, and the answer is right here in my garden.
+It has been a long day at work and I am looking forward to a quiet evening at home with my family.`,
+	"fr": `Je suis allé à l'étang ce matin et il y avait tellement de canards, plus que je n'en ai jamais vu.
+Il faisait très beau et le soleil brillait, alors nous sommes restés un moment pour les regarder nager.
+Est-ce que quelqu'un sait quel est cet oiseau ? Il a la tête verte et un collier blanc autour du cou.
+Nous aurions dû apporter du pain, mais on m'a dit que ce n'est pas bon pour eux, donc nous avons pris des graines.
+Merci à tous pour vos gentils messages sur mes photos, cela me fait vraiment plaisir.
+Qu'est-ce que vous faites ce week-end ? Je pense que je vais me promener au bord de la rivière s'il ne pleut pas.
+C'est la meilleure chose que j'ai lue cette semaine, vous devriez tous y jeter un coup d'œil quand vous aurez le temps.
+Ils ont dit que le nouveau parc serait ouvert avant la fin de l'année, mais rien ne s'est encore passé.
+Mes amis et moi parlions de tout ce qui a changé depuis que nous étions jeunes.
+Je voudrais remercier tous ceux qui sont venus hier, c'était un plaisir de vous voir tous.
+Je viens de finir un livre sur l'histoire de la ville et il était bien meilleur que ce que j'attendais.
+Si vous voulez apprendre quelque chose de nouveau, il n'y a pas de meilleur moment que maintenant pour commencer.
+Les gens me demandent souvent où j'ai pris ces photos, et la réponse est ici même dans mon jardin.
+La journée a été longue au travail et j'ai hâte de passer une soirée tranquille à la maison avec ma famille.`,
+	"es": `Fui al estanque esta mañana y había muchísimos patos, más de los que he visto nunca allí.
+Hacía muy buen tiempo y salió el sol, así que nos quedamos un rato para verlos nadar.
+¿Alguien sabe qué tipo de pájaro es este? Tiene la cabeza verde y un anillo blanco alrededor del cuello.
+Deberíamos haber traído pan, pero he oído que no es bueno para ellos, así que trajimos semillas.
+Gracias a todos por las palabras tan amables sobre mis fotos, de verdad significa mucho para mí.
+¿Qué vais a hacer este fin de semana? Creo que daré un paseo por el río si no llueve.
+Es lo mejor que he leído en toda la semana, deberíais echarle un vistazo cuando tengáis tiempo.
+Dijeron que el nuevo parque estaría abierto a finales de año, pero todavía no ha pasado nada.
+Mis amigos y yo estábamos hablando de cuánto han cambiado las cosas desde que éramos jóvenes.
+Quiero dar las gracias a todos los que vinieron ayer, fue genial veros a todos allí.
+Acabo de terminar un libro sobre la historia de la ciudad y ha sido mucho mejor de lo que esperaba.
+Si quieres aprender algo nuevo, no hay mejor momento que ahora para empezar.
+La gente me pregunta dónde hice estas fotos, y la respuesta es aquí mismo en mi jardín.
+Ha sido un día largo en el trabajo y tengo ganas de pasar una tarde tranquila en casa con mi familia.`,
+	"de": `Ich war heute Morgen am Teich und da waren so viele Enten, mehr als ich dort je gesehen habe.
+Das Wetter war herrlich und die Sonne schien, also sind wir eine Weile geblieben und haben ihnen beim Schwimmen zugesehen.
+Weiß jemand, was für ein Vogel das ist? Er hat einen grünen Kopf und einen weißen Ring um den Hals.
+Wir hätten Brot mitbringen sollen, aber ich habe gehört, dass es nicht gut für sie ist, deshalb haben wir Körner mitgenommen.
+Vielen Dank an alle für die netten Worte zu meinen Fotos, das bedeutet mir wirklich sehr viel.
+Was macht ihr dieses Wochenende? Ich glaube, ich gehe am Fluss spazieren, wenn es nicht regnet.
+Das ist das Beste, was ich die ganze Woche gelesen habe, ihr solltet es euch unbedingt ansehen, wenn ihr Zeit habt.
+Sie haben gesagt, dass der neue Park bis zum Ende des Jahres geöffnet wird, aber bisher ist nichts passiert.
+Meine Freunde und ich haben darüber gesprochen, wie sehr sich die Dinge verändert haben, seit wir jung waren.
+Ich möchte mich bei allen bedanken, die gestern gekommen sind, es war schön, euch alle zu sehen.
+Ich habe gerade ein Buch über die Geschichte der Stadt gelesen und es war viel besser, als ich erwartet hatte.
+Wenn du etwas Neues lernen willst, gibt es keinen besseren Zeitpunkt als jetzt, um damit anzufangen.
+Die Leute fragen mich immer, wo ich diese Bilder gemacht habe, und die Antwort ist hier in meinem Garten.
+Es war ein langer Tag bei der Arbeit und ich freue mich auf einen ruhigen Abend zu Hause mit meiner Familie.`,
+	"it": `Stamattina sono andato allo stagno e c'erano tantissime anatre, più di quante ne abbia mai viste lì.
+Il tempo era bellissimo e c'era il sole, quindi siamo rimasti per un po' a guardarle nuotare.
+Qualcuno sa che tipo di uccello è questo? Ha la testa verde e un anello bianco intorno al collo.
+Avremmo dovuto portare del pane, ma ho sentito che non fa bene per loro, quindi abbiamo portato dei semi.
+Grazie a tutti per le belle parole sulle mie foto, significa davvero molto per me.
+Cosa fate questo fine settimana? Penso che andrò a fare una passeggiata lungo il fiume se non piove.
+È la cosa migliore che ho letto in tutta la settimana, dovreste darci un'occhiata quando avete tempo.
+Avevano detto che il nuovo parco sarebbe stato aperto entro la fine dell'anno, ma non è ancora successo niente.
+Io e i miei amici parlavamo di quanto sono cambiate le cose da quando eravamo giovani.
+Vorrei ringraziare tutti quelli che sono venuti ieri, è stato bellissimo vedervi tutti.
+Ho appena finito di leggere un libro sulla storia della città ed era molto meglio di quanto mi aspettassi.
+Se vuoi imparare qualcosa di nuovo, non c'è momento migliore di adesso per cominciare.
+La gente mi chiede sempre dove ho scattato queste foto, e la risposta è proprio qui nel mio giardino.
+È stata una lunga giornata di lavoro e non vedo l'ora di passare una serata tranquilla a casa con la mia famiglia.`,
+	"pt": `Fui ao lago hoje de manhã e havia tantos patos, mais do que eu já tinha visto lá.
+O tempo estava lindo e fazia sol, então ficamos um pouco para vê-los nadar.
+Alguém sabe que tipo de pássaro é este? Ele tem a cabeça verde e um anel branco em volta do pescoço.
+Devíamos ter levado pão, mas ouvi dizer que não faz bem para eles, então levamos sementes.
+Obrigado a todos pelas palavras gentis sobre as minhas fotos, isso significa muito para mim.
+O que vocês vão fazer neste fim de semana? Acho que vou dar um passeio perto do rio se não chover.
+Foi a melhor coisa que li a semana toda, vocês deveriam dar uma olhada quando tiverem tempo.
+Eles disseram que o novo parque estaria aberto até o fim do ano, mas ainda não aconteceu nada.
+Eu e os meus amigos estávamos falando sobre o quanto as coisas mudaram desde que éramos jovens.
+Quero agradecer a todos que vieram ontem, foi ótimo ver vocês todos lá.
+Acabei de ler um livro sobre a história da cidade e foi muito melhor do que eu esperava.
+Se você quer aprender algo novo, não há melhor momento do que agora para começar.
+As pessoas sempre me perguntam onde tirei estas fotos, e a resposta é aqui mesmo no meu jardim.
+Foi um dia longo no trabalho e estou ansioso por uma noite tranquila em casa com a minha família.`,
+	"nl": `Ik ben vanochtend naar de vijver gegaan en er waren zoveel eenden, meer dan ik er ooit heb gezien.
+Het was heerlijk weer en de zon scheen, dus we zijn een tijdje gebleven om ze te zien zwemmen.
+Weet iemand wat voor vogel dit is? Hij heeft een groene kop en een witte ring om zijn nek.
+We hadden brood moeten meenemen, maar ik heb gehoord dat het niet goed voor ze is, dus we hebben zaadjes meegenomen.
+Bedankt allemaal voor de lieve woorden over mijn foto's, het betekent echt veel voor me.
+Wat gaan jullie dit weekend doen? Ik denk dat ik een wandeling langs de rivier ga maken als het niet regent.
+Dit is het beste wat ik de hele week heb gelezen, jullie moeten er echt eens naar kijken als je tijd hebt.
+Ze zeiden dat het nieuwe park aan het eind van het jaar open zou zijn, maar er is nog niets gebeurd.
+Mijn vrienden en ik hadden het erover hoeveel er veranderd is sinds we jong waren.
+Ik wil iedereen bedanken die gisteren is gekomen, het was geweldig om jullie allemaal te zien.
+Ik heb net een boek over de geschiedenis van de stad uitgelezen en het was veel beter dan ik had verwacht.
+Als je iets nieuws wilt leren, is er geen beter moment dan nu om ermee te beginnen.
+Mensen vragen me steeds waar ik deze foto's heb gemaakt, en het antwoord is gewoon hier in mijn tuin.
+Het was een lange dag op het werk en ik kijk uit naar een rustige avond thuis met mijn gezin.`,
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Policies for posts without a language tag.
+const (
+	untaggedInclude = "include"
+	untaggedExclude = "exclude"
+	untaggedDetect  = "detect"
+)
+
+const (
+	// detectMinLetters is the fewest letters we try to detect a Latin script
+	// language from, as short posts are too easily mistaken, and
+	// detectMinScriptLetters the fewest for a language known by its script.
+	detectMinLetters       = 12
+	detectMinScriptLetters = 4
+
+	// detectMargin is how far ahead, per trigram, the likeliest language has
+	// to be of the next before we trust it. Close languages, such as Spanish
+	// and Portuguese, often aren't told apart in a short post.
+	detectMargin = 0.2
+)
+
+// validUntaggedLanguage reports whether policy is a known policy for posts
+// without a language tag.
+func validUntaggedLanguage(policy string) bool {
+	return slices.Contains([]string{untaggedInclude, untaggedExclude, untaggedDetect}, policy)
+}
+
+// AcceptsLanguages reports whether the post is in a language the feed wants.
+// A post tagged with several languages is wanted when any of them is in
+// languages, and left out when all of them are in excluded_languages.
+func (feed *Feed) AcceptsLanguages(post *ParsedPost) bool {
+	if len(feed.Languages) == 0 && len(feed.ExcludedLanguages) == 0 {
+		return true
+	}
+	langs := post.Langs
+	if len(langs) == 0 {
+		switch feed.UntaggedLanguage {
+		case untaggedExclude:
+			return false
+		case untaggedDetect:
+			if lang, ok := detectLanguage(post.Text); ok {
+				langs = []string{lang}
+			}
+		default:
+			return true
+		}
+	} else if feed.DetectLanguage {
+		// a tag is usually the author's client default, which is often wrong
+		if lang, ok := detectLanguage(post.Text); ok && !slices.ContainsFunc(langs, func(tag string) bool { return langMatches(tag, lang) }) {
+			langs = []string{lang}
+		}
+	}
+
+	inAny := func(list []string) func(string) bool {
+		return func(lang string) bool {
+			return slices.ContainsFunc(list, func(want string) bool { return langMatches(lang, want) })
+		}
+	}
+	if len(feed.Languages) > 0 && !slices.ContainsFunc(langs, inAny(feed.Languages)) {
+		return false
+	}
+	if len(feed.ExcludedLanguages) > 0 && len(langs) > 0 {
+		excluded := inAny(feed.ExcludedLanguages)
+		return slices.ContainsFunc(langs, func(lang string) bool { return !excluded(lang) })
+	}
+	return true
+}
+
+// langProfile holds the log likelihood of each trigram seen in a language's
+// sample text, and of any trigram that wasn't.
+type langProfile struct {
+	lang   string
+	logp   map[string]float64
+	unseen float64
+}
+
+var langProfiles = sync.OnceValue(func() []*langProfile {
+	var profiles []*langProfile
+	for lang, sample := range langSamples {
+		counts := map[string]int{}
+		total := 0
+		for _, tri := range langTrigrams(sample) {
+			counts[tri]++
+			total++
+		}
+		// add one smoothing, so an unseen trigram counts against a language
+		// rather than ruling it out
+		denom := float64(total + len(counts) + 1)
+		p := &langProfile{lang: lang, logp: make(map[string]float64, len(counts)), unseen: math.Log(1 / denom)}
+		for tri, n := range counts {
+			p.logp[tri] = math.Log(float64(n+1) / denom)
+		}
+		profiles = append(profiles, p)
+	}
+	slices.SortFunc(profiles, func(a, b *langProfile) int { return strings.Compare(a.lang, b.lang) })
+	return profiles
+})
+
+// langTrigrams returns the trigrams of the words in text, each padded with a
+// space either side. Links, mentions and hashtags are left out, as they say
+// little about the language around them.
+func langTrigrams(text string) []string {
+	var trigrams []string
+	for _, field := range strings.Fields(strings.ToLower(text)) {
+		if strings.HasPrefix(field, "http") || strings.HasPrefix(field, "www.") ||
+			strings.HasPrefix(field, "@") || strings.HasPrefix(field, "#") {
+			continue
+		}
+		for _, word := range strings.FieldsFunc(field, func(r rune) bool { return !unicode.IsLetter(r) }) {
+			r := []rune(" " + word + " ")
+			for i := 0; i+3 <= len(r); i++ {
+				trigrams = append(trigrams, string(r[i:i+3]))
+			}
+		}
+	}
+	return trigrams
+}
+
+// scriptLangs are the languages told by their script alone.
+var scriptLangs = []struct {
+	script *unicode.RangeTable
+	lang   string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// detectLanguage guesses the language of text, reporting whether it is sure
+// enough. Languages with a script of their own are known by it, and the
+// Latin script languages in langSamples by their trigrams.
+func detectLanguage(text string) (string, bool) {
+	letters, latin := 0, 0
+	scripts := map[string]int{}
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, sl := range scriptLangs {
+			if unicode.Is(sl.script, r) {
+				scripts[sl.lang]++
+				break
+			}
+		}
+	}
+	if latin*2 < letters {
+		if letters < detectMinScriptLetters {
+			return "", false
+		}
+		// Japanese mixes kanji with kana, which Chinese doesn't have
+		if scripts["ja"] > 0 {
+			scripts["ja"] += scripts["zh"]
+			delete(scripts, "zh")
+		}
+		lang, most := "", 0
+		for l, n := range scripts {
+			if n > most {
+				lang, most = l, n
+			}
+		}
+		if most*2 < letters-latin {
+			return "", false
+		}
+		if lang == "ru" && strings.ContainsAny(strings.ToLower(text), "іїєґ") {
+			lang = "uk"
+		}
+		return lang, true
+	}
+
+	if letters < detectMinLetters {
+		return "", false
+	}
+	trigrams := langTrigrams(text)
+	if len(trigrams) == 0 {
+		return "", false
+	}
+	profiles := langProfiles()
+	scores := make([]float64, len(profiles))
+	for i, p := range profiles {
+		for _, tri := range trigrams {
+			if lp, ok := p.logp[tri]; ok {
+				scores[i] += lp
+			} else {
+				scores[i] += p.unseen
+			}
+		}
+	}
+	first, second := -1, -1
+	for i := range scores {
+		switch {
+		case first < 0 || scores[i] > scores[first]:
+			first, second = i, first
+		case second < 0 || scores[i] > scores[second]:
+			second = i
+		}
+	}
+	if (scores[first]-scores[second])/float64(len(trigrams)) < detectMargin {
+		return "", false
+	}
+	return profiles[first].lang, true
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		lang string // empty when the detector should abstain
+	}{
+		// Latin script languages, known by their trigrams
+		{"The ducks were swimming on the pond this morning, and they looked very happy about the weather.", "en"},
+		{"Les canards nageaient sur l'étang ce matin, et ils avaient l'air très contents du temps qu'il faisait.", "fr"},
+		{"Los patos estaban nadando en el estanque esta mañana y parecían muy contentos con el tiempo.", "es"},
+		{"Die Enten sind heute Morgen auf dem Teich geschwommen und sahen mit dem Wetter sehr zufrieden aus.", "de"},
+		{"Le anatre nuotavano nello stagno stamattina e sembravano molto contente del tempo che faceva.", "it"},
+		{"Os patos estavam nadando no lago hoje de manhã e pareciam muito felizes com o tempo.", "pt"},
+		{"De eenden zwommen vanochtend in de vijver en ze leken erg blij met het weer van vandaag.", "nl"},
+		// links, mentions and hashtags don't count towards the language
+		{"Look at these ducks @alice.example.com https://example.com/ducks #canards they are wonderful to watch", "en"},
+
+		// languages known by their script
+		{"今日は池でアヒルが泳いでいました", "ja"},
+		{"今天早上鸭子在池塘里游泳", "zh"},
+		{"오늘 아침 오리들이 연못에서 헤엄쳤어요", "ko"},
+		{"Утки плавали в пруду сегодня утром", "ru"},
+		{"Качки плавали у ставку сьогодні вранці, і їм було добре", "uk"},
+		{"Οι πάπιες κολυμπούσαν στη λίμνη σήμερα το πρωί", "el"},
+		{"كانت البطات تسبح في البركة هذا الصباح", "ar"},
+		{"הברווזים שחו בבריכה הבוקר", "he"},
+		{"เป็ดว่ายน้ำในบ่อเมื่อเช้านี้", "th"},
+		{"आज सुबह बत्तखें तालाब में तैर रही थीं", "hi"},
+
+		// too short to be sure of
+		{"lol ok", ""},
+		{"ducks!", ""},
+		{"日本", ""},
+		{"", ""},
+		{"🦆🦆🦆 12345", ""},
+		// close languages that a short post doesn't tell apart
+		{"Mira este patito nadando bajo la lluvia, ¿no es precioso?", ""},
+	} {
+		lang, ok := detectLanguage(tc.text)
+		if tc.lang == "" {
+			if ok {
+				t.Errorf("detectLanguage(%q) = %q, want no guess", tc.text, lang)
+			}
+			continue
+		}
+		if !ok || lang != tc.lang {
+			t.Errorf("detectLanguage(%q) = %q, %v, want %q", tc.text, lang, ok, tc.lang)
+		}
+	}
+}
+
+func TestAcceptsLanguages(t *testing.T) {
+	const french = "Les canards nageaient sur l'étang ce matin, et ils avaient l'air très contents du temps qu'il faisait."
+	for _, tc := range []struct {
+		name  string
+		feed  *Feed
+		text  string
+		langs []string
+		want  bool
+	}{
+		{"untagged included by default", &Feed{Languages: []string{"fr"}}, "lol ok", nil, true},
+		{"untagged excluded", &Feed{Languages: []string{"fr"}, UntaggedLanguage: untaggedExclude}, french, nil, false},
+		{"untagged detected", &Feed{Languages: []string{"fr"}, UntaggedLanguage: untaggedDetect}, french, nil, true},
+		{"untagged detected as excluded", &Feed{ExcludedLanguages: []string{"fr"}, UntaggedLanguage: untaggedDetect}, french, nil, false},
+		// a post too short to detect has no known language
+		{"short untagged left out by languages", &Feed{Languages: []string{"fr"}, UntaggedLanguage: untaggedDetect}, "lol ok", nil, false},
+		{"short untagged kept by excluded_languages", &Feed{ExcludedLanguages: []string{"fr"}, UntaggedLanguage: untaggedDetect}, "lol ok", nil, true},
+		{"tag matches a more specific tag", &Feed{Languages: []string{"en"}}, "hello", []string{"en-GB"}, true},
+		{"wrong tag corrected", &Feed{Languages: []string{"fr"}, DetectLanguage: true}, french, []string{"en"}, true},
+		{"wrong tag kept without detection", &Feed{Languages: []string{"fr"}}, french, []string{"en"}, false},
+		{"short tagged post keeps its tags", &Feed{Languages: []string{"en"}, DetectLanguage: true}, "lol ok", []string{"en"}, true},
+		{"excluded only when every tag is", &Feed{ExcludedLanguages: []string{"fr"}}, french, []string{"fr", "en"}, true},
+	} {
+		post := &ParsedPost{Text: tc.text, Langs: tc.langs}
+		if got := tc.feed.AcceptsLanguages(post); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
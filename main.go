@@ -7,19 +7,19 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bluesky-social/jetstream/pkg/client"
-	"github.com/bluesky-social/jetstream/pkg/client/schedulers/sequential"
 	"github.com/bluesky-social/jetstream/pkg/models"
 	"github.com/charmbracelet/log"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 const (
-	serverAddr = "wss://jetstream2.us-east.bsky.network/subscribe"
-	pdsHost    = "https://shimeji.us-east.host.bsky.network"
+	pdsHost = "https://shimeji.us-east.host.bsky.network"
 )
 
 var cfg *Config
@@ -28,13 +28,26 @@ var fConfigName = flag.String("config", "feeds.hcl", "HCL Config file for feeds"
 func main() {
 	flag.Parse()
 
-hupRentry:
-	var needsHUP = false
-
-	ctx, cancelFunc := context.WithCancel(context.Background())
 	slog.SetDefault(slog.New(&charmSLogHandler{}))
 	logger := log.Default()
 
+	// the jetstream connection outlives config reloads, so that we don't miss
+	// events while the feeds restart
+	h := &handler{
+		seenSeqs: make(map[int64]struct{}),
+	}
+	var src eventSource
+	var scheduler client.Scheduler
+	srcCtx, srcCancel := context.WithCancel(context.Background())
+	defer srcCancel()
+
+	// attach signal handlers
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
+
+hupRentry:
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
 	var err error
 
 	cfg, err = readConfig(*fConfigName)
@@ -58,6 +71,7 @@ hupRentry:
 				if err != nil {
 					log.Fatalf("failed to publish feed: %v", err)
 				}
+				cancelFunc()
 				return
 			}
 		}
@@ -65,87 +79,103 @@ hupRentry:
 		os.Exit(1)
 	}
 
-	config := client.DefaultClientConfig()
-	config.WebsocketURL = serverAddr
-	config.Compress = true
-
-	h := &handler{
-		seenSeqs: make(map[int64]struct{}),
+	if *fBackfillCarFeed != "" {
+		err := backfillCars(ctx, *fBackfillCarFeed, flag.Args())
+		cancelFunc()
+		if err != nil {
+			log.Fatalf("failed to backfill feed: %v", err)
+		}
+		return
 	}
 
-	scheduler := sequential.NewScheduler("jetstream_localdev", slog.Default(), h.HandleEvent)
-
-	c, err := client.NewClient(config, slog.Default(), scheduler)
-	if err != nil {
-		log.Error("failed to create client: %v", err)
-		os.Exit(1)
+	if h.archive != nil {
+		h.archive.Close()
+		h.archive = nil
 	}
-
-	cursor := time.Now().Add(10 * -time.Minute).UnixMicro()
-
-	// Every 5 seconds print the events read and bytes read and average event size
-	go func() {
-		ticker := time.NewTicker(2 * time.Second)
-		lctx, _ := context.WithCancel(ctx)
-		for {
-			select {
-			case <-lctx.Done():
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				cursor = time.Now().Add(100 * -time.Millisecond).UnixMicro()
-			}
+	if cfg.Archive != nil {
+		if h.archive, err = openArchive(cfg.Archive); err != nil {
+			log.Error("Failed to open archive", "error", err)
 		}
-	}()
+	}
 
-	// start up services for feeds
+	// start up services for feeds, catching up new feeds from the archive
+	// before they see any live events
 	for _, feed := range cfg.Feeds {
-		httpctx, _ := context.WithCancel(ctx)
-		startFeedService(httpctx, feed)
-		dbctx, _ := context.WithCancel(ctx)
-		postWriter(dbctx, feed)
+		startFeedService(ctx, feed)
+		postWriter(ctx, feed)
+		if err := feed.loadAuthors(); err != nil {
+			log.Error("Failed to load feed authors", "feed", feed.ID, "error", err)
+		}
+		go feed.runAdmission(ctx)
+		go feed.runCurators(ctx)
 		feed.StartProcessing(logger)
+		startBackfill(feed, h.archive)
 	}
 
-	// attach signal handlers
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
+	if src == nil {
+		scheduler = &trackingScheduler{next: newScheduler(cfg.Jetstream, h.HandleEvent), p: &h.progress}
+		if *fRecord != "" {
+			if scheduler, err = newRecordingScheduler(*fRecord, scheduler); err != nil {
+				log.Error("Failed to open recording", "error", err)
+				os.Exit(1)
+			}
+		}
+		src, err = newEventSource(*fSource, cfg, scheduler)
+		if err != nil {
+			log.Error("Failed to create event source", "error", err)
+			os.Exit(1)
+		}
+		cursor := resumeCursor(cfg.Feeds, src.CursorService())
 
+		// we begin reading from the jetstream here
+		// it sometimes will fail and disconnect, so we rewind the cursor
+		// from the last event we handled and retry on the next endpoint.
+		// database is keyed on post uri being unique, so there won't
+		// be dupes, and we reduce the risk of missing posts
+		go src.Run(srcCtx, cursor, func() int64 {
+			return src.Checkpoint(h.Cursor(), cfg.cursorRewind)
+		})
+	} else {
+		if err := src.Reconfigure(cfg); err != nil {
+			log.Error("Failed to update jetstream subscription", "error", err)
+		}
+		// events have been held while the feeds restarted
+		h.Unlock()
+	}
+
+	// periodically checkpoint the events we have processed, so that a
+	// restart can pick up where we left off
 	go func() {
-		signal := <-sigs
-		log.Info("signal received", "signal", signal)
-		switch signal {
-		case syscall.SIGHUP:
-			for _, feed := range cfg.Feeds {
-				feed.Stop()
-			}
-			cancelFunc()
-			needsHUP = true
-		case syscall.SIGTERM, syscall.SIGINT:
-			for _, feed := range cfg.Feeds {
-				feed.Stop()
+		ticker := time.NewTicker(cfg.cursorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.RLock()
+				checkpointCursor(cfg.Feeds, src.CursorService(), src.Checkpoint(h.Cursor(), cfg.cursorRewind))
+				h.RUnlock()
 			}
-			cancelFunc()
-			log.Info("shutting down gracefully")
-			time.Sleep(5 * time.Second)
 		}
 	}()
 
-retry:
+	signal := <-sigs
+	log.Info("signal received", "signal", signal)
 
-	// we begin reading from the jetstream here
-	// it sometimes will fail and disconnect, so we reset the cursor
-	// back one second and retry if it fails.
-	// database is keyed on post uri being unique, so there won't
-	// be dupes, and we reduce the risk of missing posts
-	if err := c.ConnectAndRead(ctx, &cursor); err != nil {
-		cursor = time.Now().Add(1000 * -time.Millisecond).UnixMicro()
-		goto retry
+	// hold events back until the feeds are running again, as the workers
+	// can't take any more work once stopped, and checkpoint once the work
+	// they had queued is done
+	h.Lock()
+	for _, feed := range cfg.Feeds {
+		feed.Stop()
 	}
+	checkpointCursor(cfg.Feeds, src.CursorService(), src.Checkpoint(h.Cursor(), cfg.cursorRewind))
+	cancelFunc()
 
-	// if the signal handler flagged that SIGHUP has been received, we'll all time
-	// for context cancellations for running goroutines, and then restart
-	if needsHUP {
+	// if SIGHUP has been received, we'll allow time for context cancellations
+	// for running goroutines, and then restart
+	if signal == syscall.SIGHUP {
 		time.Sleep(5 * time.Second)
 		log.Info("=================================================================================")
 		log.Info(" A SERVICE HUP WAS REQUESTED")
@@ -154,8 +184,14 @@ retry:
 		log.Info(" will be re-read from disk, so that changes can be applied.")
 		log.Info("=================================================================================")
 		goto hupRentry
-	} else {
-		time.Sleep(5 * time.Second)
+	}
+
+	srcCancel()
+	log.Info("shutting down gracefully")
+	time.Sleep(5 * time.Second)
+	scheduler.Shutdown()
+	if h.archive != nil {
+		h.archive.Close()
 	}
 
 	// service finally stopped
@@ -163,20 +199,76 @@ retry:
 }
 
 type handler struct {
-	seenSeqs  map[int64]struct{}
-	highwater int64
+	seenSeqs map[int64]struct{}
+	progress progress
+	archive  *eventArchive
+	sync.RWMutex
 }
 
 func (h *handler) HandleEvent(ctx context.Context, event *models.Event) error {
-	// Unmarshal the record if there is one
-	if event.Commit != nil && (event.Commit.Operation == models.CommitOperationCreate || event.Commit.Operation == models.CommitOperationUpdate) {
+	h.RLock()
+	defer h.RUnlock()
+	// the event stays in flight until the feed workers are done with it
+	ref := h.progress.handle(event)
+	defer ref.release()
+
+	if event.Account != nil {
+		// account changes queue behind the posts they may hide or purge
+		for _, feed := range cfg.Feeds {
+			feed.worker.AddWorkDone(&feedWork{Account: event.Account}, ref.hold())
+		}
+	}
+	if event.Commit != nil {
 		switch event.Commit.Collection {
 		case "app.bsky.feed.post":
+			if h.archive != nil {
+				h.archive.Add(event)
+			}
+			// the post is decoded once here and shared by every feed
+			post, err := parsePost(event)
+			if err != nil {
+				log.Debug("Skipping post", "did", event.Did, "rkey", event.Commit.RKey, "error", err)
+				break
+			}
+			for _, feed := range cfg.Feeds {
+				feed.worker.AddWorkDone(&feedWork{Post: post}, ref.hold())
+			}
+		case profileCollection:
+			p, err := parseProfile(event)
+			if err != nil {
+				log.Debug("Skipping profile", "did", event.Did, "error", err)
+				break
+			}
 			for _, feed := range cfg.Feeds {
-				feed.worker.AddWork(event)
+				if feed.RespectNoUnauthenticated {
+					feed.worker.AddWorkDone(&feedWork{Profile: p}, ref.hold())
+				}
+			}
+		case likeCollection, repostCollection, followCollection, blockCollection:
+			e, err := parseEngagement(event)
+			if err != nil {
+				log.Debug("Skipping engagement", "did", event.Did, "rkey", event.Commit.RKey, "error", err)
+				break
+			}
+			// feeds only follow blocks and follows of the feed owner, so
+			// there is no need to queue the rest. Deletes don't say who
+			// they were of, so they all go through.
+			if (e.Collection == followCollection || e.Collection == blockCollection) &&
+				!e.IsDelete() && e.Subject != cfg.Base {
+				break
+			}
+			// engagement queues behind the posts it may be for
+			for _, feed := range cfg.Feeds {
+				if slices.Contains(feed.WantedCollections(), e.Collection) {
+					feed.worker.AddWorkDone(&feedWork{Engagement: e}, ref.hold())
+				}
 			}
 		}
 	}
-
 	return nil
 }
+
+// Cursor returns the time up to which every event has been processed.
+func (h *handler) Cursor() int64 {
+	return h.progress.Cursor()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+// benchmarkConfig reads a config with n feeds, each matching its own word.
+func benchmarkConfig(b *testing.B, n int) *Config {
+	b.Helper()
+	var hcl strings.Builder
+	hcl.WriteString("feed_owner = \"x\"\nfeed_base = \"did:plc:owner\"\n")
+	for i := range n {
+		fmt.Fprintf(&hcl, "feed \"f%d\" {\n  name = \"f%d\"\n  port = %d\n  match_expr = \"word%d|ducks?\"\n  database = \"f%d.db\"\n}\n", i, i, 20000+i, i, i)
+	}
+	path := filepath.Join(b.TempDir(), "feeds.hcl")
+	if err := os.WriteFile(path, []byte(hcl.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+	config, err := readConfig(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return config
+}
+
+// benchmarkEvent is a post with the facets, embed and labels a busy post
+// tends to carry.
+var benchmarkEvent = &models.Event{
+	Did:    "did:plc:author",
+	TimeUS: 1792308711797713,
+	Kind:   models.EventKindCommit,
+	Commit: &models.Commit{
+		Operation:  models.CommitOperationCreate,
+		Collection: "app.bsky.feed.post",
+		RKey:       "3kbenchmark",
+		CID:        "bafyreibenchmark",
+		Record: json.RawMessage(`{
+			"$type": "app.bsky.feed.post",
+			"text": "Spent the morning at the pond with @alice.example.com watching the ducks, more photos at example.com/ducks #ducks #birds",
+			"createdAt": "2026-10-18T08:00:00Z",
+			"langs": ["en"],
+			"facets": [
+				{"index": {"byteStart": 35, "byteEnd": 53}, "features": [{"$type": "app.bsky.richtext.facet#mention", "did": "did:plc:alice"}]},
+				{"index": {"byteStart": 88, "byteEnd": 105}, "features": [{"$type": "app.bsky.richtext.facet#link", "uri": "https://example.com/ducks"}]},
+				{"index": {"byteStart": 106, "byteEnd": 112}, "features": [{"$type": "app.bsky.richtext.facet#tag", "tag": "ducks"}]},
+				{"index": {"byteStart": 113, "byteEnd": 119}, "features": [{"$type": "app.bsky.richtext.facet#tag", "tag": "birds"}]}
+			],
+			"embed": {
+				"$type": "app.bsky.embed.images",
+				"images": [
+					{"alt": "Two mallards on the water", "image": {"$type": "blob", "ref": {"$link": "bafkreiglmpzaxt5t6yjp6vrccxhqjmnhzfiqrhf5tx2hmmd6ol5xdjqqse"}, "mimeType": "image/jpeg", "size": 123456}}
+				]
+			},
+			"labels": {"$type": "com.atproto.label.defs#selfLabels", "values": []}
+		}`),
+	},
+}
+
+// BenchmarkHandleEvent compares decoding a post event once and sharing it
+// between feeds, as HandleEvent does, with each feed decoding the record for
+// itself.
+func BenchmarkHandleEvent(b *testing.B) {
+	for _, n := range []int{1, 10, 50} {
+		cfg = benchmarkConfig(b, n)
+		b.Run(fmt.Sprintf("feeds=%d/per-feed", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				for _, feed := range cfg.Feeds {
+					post, err := parsePost(benchmarkEvent)
+					if err != nil {
+						b.Fatal(err)
+					}
+					feed.Matches(post)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("feeds=%d/shared", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				post, err := parsePost(benchmarkEvent)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, feed := range cfg.Feeds {
+					feed.Matches(post)
+				}
+			}
+		})
+	}
+}
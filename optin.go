@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+)
+
+const followCollection = "app.bsky.graph.follow"
+
+// OptInConfig limits a feed to authors who have joined it, by liking the
+// join post or following the feed owner.
+type OptInConfig struct {
+	JoinPost string `hcl:"join_post,optional"`
+	Follow   bool   `hcl:"follow,optional"`
+	Purge    bool   `hcl:"purge,optional"`
+	members  authorSet
+}
+
+// OptIn is a like or follow by which an author joined a feed.
+type OptIn struct {
+	URI string `gorm:"primaryKey"`
+	Did string `gorm:"index"`
+}
+
+// IsMember reports whether did has joined the feed.
+func (oc *OptInConfig) IsMember(did string) bool {
+	return oc.members.Has(did)
+}
+
+func (oc *OptInConfig) Members() int {
+	return oc.members.Len()
+}
+
+// joins reports whether a like or follow is one that joins the feed.
+func (oc *OptInConfig) joins(e *ParsedEngagement) bool {
+	switch e.Collection {
+	case likeCollection:
+		return oc.JoinPost != "" && e.Subject == oc.JoinPost
+	case followCollection:
+		return oc.Follow && e.Subject == cfg.Base
+	}
+	return false
+}
+
+// loadAuthors reads the authors who have blocked the feed owner, asked not
+// to be shown logged out if the feed respects that, had their posts hidden,
+// or joined the feed, from its database.
+func (feed *Feed) loadAuthors() error {
+	feed.blocked.table = "blocks"
+	if err := feed.blocked.load(feed.db); err != nil {
+		return err
+	}
+	feed.noUnauth.table = "no_unauthenticateds"
+	if feed.RespectNoUnauthenticated {
+		if err := feed.noUnauth.load(feed.db); err != nil {
+			return err
+		}
+	}
+	feed.hidden.table = "hidden_authors"
+	if err := feed.hidden.load(feed.db); err != nil {
+		return err
+	}
+	oc := feed.OptIn
+	if oc == nil {
+		return nil
+	}
+	oc.members.table = "opt_ins"
+	if err := oc.members.load(feed.db); err != nil {
+		return err
+	}
+	log.Info("Loaded opted in authors", "feed", feed.ID, "authors", oc.members.Len())
+	return nil
+}
+
+// handleOptIn adds an author who liked the join post or followed the feed
+// owner, and removes them again when they take back the last of those.
+func (feed *Feed) handleOptIn(e *ParsedEngagement) {
+	oc := feed.OptIn
+	if e.IsDelete() {
+		did, ok, left := oc.members.remove(feed, e.URI)
+		if ok && left {
+			log.Info("Author left feed", "feed", feed.ID, "did", did)
+			if oc.Purge {
+				feed.purgeAuthor(did, "left feed")
+			}
+		}
+		return
+	}
+	if e.Operation != models.CommitOperationCreate || !oc.joins(e) {
+		return
+	}
+	if _, joined := oc.members.add(feed, e.URI, e.Did); joined {
+		log.Info("Author joined feed", "feed", feed.ID, "did", e.Did)
+	}
+}
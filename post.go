@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	apibsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+// ParsedPost is a post event decoded once and shared by every feed, which
+// must treat it as read-only. Deletes carry no record, so only the fields
+// identifying the post are set for them.
+type ParsedPost struct {
+	URI       string
+	Did       string
+	RKey      string
+	CID       string
+	Operation string
+	TimeUS    int64
+	CreatedAt time.Time
+
+	Text       string
+	Langs      []string
+	SelfLabels []string
+
+	// from the post's facets and tags, with the tags normalized
+	Tags     []string
+	Mentions []string
+	Links    []string
+
+	// from the post's embed, including the media of a record with media
+	Images   []EmbeddedImage
+	Video    *EmbeddedVideo
+	External *EmbeddedExternal
+	QuoteURI string
+
+	ReplyParent string
+	ReplyRoot   string
+}
+
+type EmbeddedImage struct {
+	Alt string
+}
+
+type EmbeddedVideo struct {
+	Alt string
+}
+
+type EmbeddedExternal struct {
+	URI         string
+	Title       string
+	Description string
+}
+
+func (p *ParsedPost) IsReply() bool {
+	return p.ReplyParent != ""
+}
+
+func (p *ParsedPost) IsDelete() bool {
+	return p.Operation == models.CommitOperationDelete
+}
+
+// parsePost decodes a post commit event.
+func parsePost(event *models.Event) (*ParsedPost, error) {
+	if event.Commit.Operation == models.CommitOperationDelete {
+		return newParsedPost(event.Did, event.Commit.RKey, event.Commit.CID, event.Commit.Operation, event.TimeUS, nil), nil
+	}
+	var record apibsky.FeedPost
+	if err := json.Unmarshal(event.Commit.Record, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal post: %w", err)
+	}
+	return newParsedPost(event.Did, event.Commit.RKey, event.Commit.CID, event.Commit.Operation, event.TimeUS, &record), nil
+}
+
+func newParsedPost(did, rkey, cid, operation string, timeUS int64, record *apibsky.FeedPost) *ParsedPost {
+	p := &ParsedPost{
+		URI:       fmt.Sprintf("at://%s/app.bsky.feed.post/%s", did, rkey),
+		Did:       did,
+		RKey:      rkey,
+		CID:       cid,
+		Operation: operation,
+		TimeUS:    timeUS,
+		CreatedAt: time.UnixMicro(timeUS),
+	}
+	if record == nil {
+		return p
+	}
+
+	if dt, err := syntax.ParseDatetimeLenient(record.CreatedAt); err == nil {
+		p.CreatedAt = dt.Time()
+	}
+	p.Text = record.Text
+	p.Langs = record.Langs
+	if record.Labels != nil {
+		p.SelfLabels = selfLabelValues(record.Labels.LabelDefs_SelfLabels)
+	}
+	p.Tags = append(p.Tags, record.Tags...)
+	for _, facet := range record.Facets {
+		for _, feature := range facet.Features {
+			switch {
+			case feature.RichtextFacet_Tag != nil:
+				p.Tags = append(p.Tags, feature.RichtextFacet_Tag.Tag)
+			case feature.RichtextFacet_Mention != nil:
+				p.Mentions = append(p.Mentions, feature.RichtextFacet_Mention.Did)
+			case feature.RichtextFacet_Link != nil:
+				p.Links = append(p.Links, feature.RichtextFacet_Link.Uri)
+			}
+		}
+	}
+	p.Tags = normalizeTags(p.Tags)
+
+	if embed := record.Embed; embed != nil {
+		switch {
+		case embed.EmbedImages != nil:
+			p.addImages(embed.EmbedImages)
+		case embed.EmbedVideo != nil:
+			p.addVideo(embed.EmbedVideo)
+		case embed.EmbedExternal != nil:
+			p.addExternal(embed.EmbedExternal)
+		case embed.EmbedRecord != nil:
+			if embed.EmbedRecord.Record != nil {
+				p.QuoteURI = embed.EmbedRecord.Record.Uri
+			}
+		case embed.EmbedRecordWithMedia != nil:
+			rwm := embed.EmbedRecordWithMedia
+			if rwm.Record != nil && rwm.Record.Record != nil {
+				p.QuoteURI = rwm.Record.Record.Uri
+			}
+			if media := rwm.Media; media != nil {
+				switch {
+				case media.EmbedImages != nil:
+					p.addImages(media.EmbedImages)
+				case media.EmbedVideo != nil:
+					p.addVideo(media.EmbedVideo)
+				case media.EmbedExternal != nil:
+					p.addExternal(media.EmbedExternal)
+				}
+			}
+		}
+	}
+
+	if record.Reply != nil {
+		if record.Reply.Parent != nil {
+			p.ReplyParent = record.Reply.Parent.Uri
+		}
+		if record.Reply.Root != nil {
+			p.ReplyRoot = record.Reply.Root.Uri
+		}
+	}
+	return p
+}
+
+func (p *ParsedPost) addImages(images *apibsky.EmbedImages) {
+	for _, img := range images.Images {
+		if img != nil {
+			p.Images = append(p.Images, EmbeddedImage{Alt: img.Alt})
+		}
+	}
+}
+
+func (p *ParsedPost) addVideo(video *apibsky.EmbedVideo) {
+	p.Video = &EmbeddedVideo{}
+	if video.Alt != nil {
+		p.Video.Alt = *video.Alt
+	}
+}
+
+func (p *ParsedPost) addExternal(external *apibsky.EmbedExternal) {
+	if ext := external.External; ext != nil {
+		p.External = &EmbeddedExternal{
+			URI:         ext.Uri,
+			Title:       ext.Title,
+			Description: ext.Description,
+		}
+	}
+}
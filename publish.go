@@ -116,17 +116,21 @@ func publishFeedGen(ctx context.Context, host string, handle string, password st
 
 	log.Printf("Res: %#v", res)
 
-	rec := &lexutil.LexiconTypeDecoder{Val: &bsky.FeedGenerator{
+	gen := &feedGeneratorRecord{FeedGenerator: bsky.FeedGenerator{
 		CreatedAt:   time.Now().Format(util.ISO8601),
 		Description: &desc,
 		Did:         did,
 		DisplayName: name,
 	}}
+	if cfg.VideoOnly() {
+		gen.ContentMode = contentModeVideo
+	}
+	rec := &lexutil.LexiconTypeDecoder{Val: gen}
 
 	if img != "" {
 		avRef, err := uploadBlob(ctx, xrpcc, img)
 		if err == nil && avRef != nil {
-			rec.Val.(*bsky.FeedGenerator).Avatar = avRef
+			gen.Avatar = avRef
 		}
 	}
 
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	rankLatest = "latest"
+	rankHot    = "hot"
+	rankTop    = "top"
+
+	defaultHotHalfLife   = 6 * time.Hour
+	defaultHotWindow     = 48 * time.Hour
+	defaultTopWindow     = 24 * time.Hour
+	defaultRankSnapshot  = 30 * time.Minute
+	rankRefresh          = time.Minute
+	maxRankSnapshots     = 64
+	maxRankedPosts       = 1000
+	repostWeight         = 2
+	hotGravityOffsetHour = 2
+)
+
+// RankingConfig sets how a feed orders its posts. Posts are newest first for
+// "latest", while "hot" scores engagement decayed by age, and "top" orders
+// the posts of a recent window by engagement alone.
+type RankingConfig struct {
+	Mode     string  `hcl:"mode"`
+	Gravity  float64 `hcl:"gravity,optional"`
+	HalfLife string  `hcl:"half_life,optional"`
+	Window   string  `hcl:"window,optional"`
+	Snapshot string  `hcl:"snapshot,optional"`
+	halfLife time.Duration
+	window   time.Duration
+	snapshot time.Duration
+}
+
+func (rc *RankingConfig) parse() error {
+	var err error
+	switch rc.Mode {
+	case rankLatest:
+		return nil
+	case rankHot:
+		rc.halfLife = defaultHotHalfLife
+		rc.window = defaultHotWindow
+	case rankTop:
+		rc.window = defaultTopWindow
+	default:
+		return fmt.Errorf("unknown ranking mode %q", rc.Mode)
+	}
+	if rc.HalfLife != "" {
+		if rc.halfLife, err = time.ParseDuration(rc.HalfLife); err != nil {
+			return fmt.Errorf("invalid ranking half_life: %w", err)
+		}
+	}
+	if rc.Window != "" {
+		if rc.window, err = time.ParseDuration(rc.Window); err != nil {
+			return fmt.Errorf("invalid ranking window: %w", err)
+		}
+	}
+	rc.snapshot = defaultRankSnapshot
+	if rc.Snapshot != "" {
+		if rc.snapshot, err = time.ParseDuration(rc.Snapshot); err != nil {
+			return fmt.Errorf("invalid ranking snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// Ranked reports whether the feed orders posts by score rather than time.
+func (rc *RankingConfig) Ranked() bool {
+	return rc != nil && rc.Mode != rankLatest
+}
+
+// score rates a post indexed at indexedAt with the given engagement.
+func (rc *RankingConfig) score(engagement float64, indexedAt, now time.Time) float64 {
+	if rc.Mode == rankTop {
+		return engagement
+	}
+	age := now.Sub(indexedAt)
+	if age < 0 {
+		age = 0
+	}
+	// gravity decays like hacker news, and otherwise the score halves
+	// every half life
+	if rc.Gravity > 0 {
+		return (engagement + 1) / math.Pow(age.Hours()+hotGravityOffsetHour, rc.Gravity)
+	}
+	return (engagement + 1) * math.Exp2(-float64(age)/float64(rc.halfLife))
+}
+
+// rankSnapshot is a ranking of a feed's posts, kept so that paging through
+// it isn't upset by scores changing between pages.
+type rankSnapshot struct {
+	id      string
+	uris    []string
+	ranked  time.Time
+	expires time.Time
+}
+
+// rankCache holds a feed's ranking snapshots. First pages share the newest
+// snapshot until it is rankRefresh old, so there is at most one snapshot per
+// refresh, and never more than maxRankSnapshots.
+type rankCache struct {
+	snapshots map[string]*rankSnapshot
+	latest    *rankSnapshot
+	ranking   sync.Mutex
+	sync.Mutex
+}
+
+func (rc *rankCache) get(id string) *rankSnapshot {
+	rc.Lock()
+	defer rc.Unlock()
+	s := rc.snapshots[id]
+	if s == nil || time.Now().After(s.expires) {
+		return nil
+	}
+	return s
+}
+
+// fresh returns the newest snapshot, calling rank for a new one if it is due
+// a refresh. Only one caller ranks at a time, and the rest share its result.
+func (rc *rankCache) fresh(rank func() ([]string, error), ttl time.Duration) (*rankSnapshot, error) {
+	rc.ranking.Lock()
+	defer rc.ranking.Unlock()
+	rc.Lock()
+	latest := rc.latest
+	rc.Unlock()
+	if latest != nil && time.Since(latest.ranked) < min(rankRefresh, ttl) {
+		return latest, nil
+	}
+	uris, err := rank()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s := &rankSnapshot{
+		id:      strconv.FormatUint(rand.Uint64(), 36),
+		uris:    uris,
+		ranked:  now,
+		expires: now.Add(ttl),
+	}
+	rc.add(s)
+	return s, nil
+}
+
+func (rc *rankCache) add(s *rankSnapshot) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.snapshots == nil {
+		rc.snapshots = map[string]*rankSnapshot{}
+	}
+	for id, old := range rc.snapshots {
+		if s.ranked.After(old.expires) {
+			delete(rc.snapshots, id)
+		}
+	}
+	for len(rc.snapshots) >= maxRankSnapshots {
+		var oldest *rankSnapshot
+		for _, old := range rc.snapshots {
+			if oldest == nil || old.ranked.Before(oldest.ranked) {
+				oldest = old
+			}
+		}
+		delete(rc.snapshots, oldest.id)
+	}
+	rc.snapshots[s.id] = s
+	rc.latest = s
+}
+
+// rank scores the feed's recent posts and returns them best first.
+func (feed *Feed) rank() ([]string, error) {
+	rc := feed.Ranking
+	now := time.Now()
+	since := fmt.Sprintf("%d", now.Add(-rc.window).UnixMilli())
+	var posts []*Post
+	err := feed.db.Select("uri", "indexed_at", "likes", "reposts").
+		Where("state = '' and not hidden and indexed_at >= ?", since).
+		Order("indexed_at desc").
+		Limit(maxRankedPosts * 10).
+		Find(&posts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	type scored struct {
+		uri   string
+		score float64
+		at    int64
+	}
+	ranked := make([]scored, 0, len(posts))
+	for _, p := range posts {
+		ms, _ := strconv.ParseInt(p.IndexedAt, 10, 64)
+		engagement := float64(p.Likes + repostWeight*p.Reposts)
+		ranked = append(ranked, scored{
+			uri:   p.URI,
+			score: rc.score(engagement, time.UnixMilli(ms), now),
+			at:    ms,
+		})
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].at > ranked[j].at
+	})
+	if len(ranked) > maxRankedPosts {
+		ranked = ranked[:maxRankedPosts]
+	}
+	uris := make([]string, len(ranked))
+	for i, s := range ranked {
+		uris[i] = s.uri
+	}
+	return uris, nil
+}
+
+// rankedPage returns a page of the feed's ranking and the cursor for the
+// next, or an empty cursor at the end. The first page comes from the newest
+// snapshot, ranking the feed afresh if it is due a refresh, and later pages
+// come from the same snapshot, or the newest if it has expired.
+func (feed *Feed) rankedPage(cursor string, limit int) ([]string, string, error) {
+	var snap *rankSnapshot
+	offset := 0
+	if cursor != "" {
+		parts := strings.SplitN(cursor, "::", 2)
+		if len(parts) != 2 {
+			return nil, "", fmt.Errorf("malformed cursor")
+		}
+		var err error
+		if offset, err = strconv.Atoi(parts[1]); err != nil || offset < 0 {
+			return nil, "", fmt.Errorf("malformed cursor")
+		}
+		snap = feed.rankings.get(parts[0])
+		if snap == nil {
+			log.Debug("Ranking snapshot expired, ranking again", "feed", feed.ID, "snapshot", parts[0])
+		}
+	}
+	if snap == nil {
+		var err error
+		if snap, err = feed.rankings.fresh(feed.rank, feed.Ranking.snapshot); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if offset >= len(snap.uris) {
+		return nil, "", nil
+	}
+	end := min(offset+limit, len(snap.uris))
+	next := ""
+	if end < len(snap.uris) {
+		next = fmt.Sprintf("%s::%d", snap.id, end)
+	}
+	return snap.uris[offset:end], next, nil
+}
@@ -12,6 +12,10 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+// maxFeedLimit is the most posts a client may ask for in one page, as in the
+// getFeedSkeleton lexicon.
+const maxFeedLimit = 100
+
 type PostRec struct {
 	Post string `json:"post"`
 }
@@ -48,6 +52,10 @@ func startFeedService(ctx context.Context, cfg *Feed) {
 		c.JSONBlob(http.StatusOK, getDIDDoc(cfg))
 		return nil
 	})
+	r.GET("/stats", func(c echo.Context) error {
+		c.JSON(http.StatusOK, cfg.Stats())
+		return nil
+	})
 	r.GET("/xrpc/app.bsky.feed.getFeedSkeleton", func(c echo.Context) error {
 		feed := c.QueryParam("feed")
 		limit := c.QueryParam("limit")
@@ -69,6 +77,33 @@ func startFeedService(ctx context.Context, cfg *Feed) {
 				c.String(400, fmt.Sprintf("Bad request: malformed limit param"))
 				return nil
 			}
+			if iLimit < 1 || iLimit > maxFeedLimit {
+				c.String(400, fmt.Sprintf("Bad request: limit must be between 1 and %d", maxFeedLimit))
+				return nil
+			}
+			if cfg.Ranking.Ranked() {
+				uris, next, err := cfg.rankedPage(cursor, int(iLimit))
+				if err != nil {
+					c.String(400, fmt.Sprintf("Bad request: %s", err))
+					return nil
+				}
+				if len(uris) > 0 {
+					list := &PostList{
+						Cursor: next,
+						Feed:   []PostRec{},
+					}
+					if cursor == "" && cfg.PinnedURI != "" {
+						list.Feed = append(list.Feed, PostRec{cfg.PinnedURI})
+					}
+					for _, uri := range uris {
+						list.Feed = append(list.Feed, PostRec{uri})
+					}
+					c.JSON(http.StatusOK, list)
+					return nil
+				}
+				c.String(404, fmt.Sprintf("Posts not found"))
+				return nil
+			}
 			if cursor != "" && strings.Contains(cursor, "::") {
 				parts := strings.SplitN(cursor, "::", 2)
 				ts = parts[0]
@@ -85,9 +120,9 @@ func startFeedService(ctx context.Context, cfg *Feed) {
 			}
 			var posts = []*Post{}
 			if ts != "" && cid != "" {
-				cfg.db.Limit(int(iLimit)).Where("c_id < ? and (indexed_at < ? or indexed_at = ?)", cid, ts, ts).Order("indexed_at desc, c_id desc").Find(&posts)
+				cfg.db.Limit(int(iLimit)).Where("state = '' and not hidden and c_id < ? and (indexed_at < ? or indexed_at = ?)", cid, ts, ts).Order("indexed_at desc, c_id desc").Find(&posts)
 			} else {
-				cfg.db.Limit(int(iLimit)).Order("indexed_at desc, c_id desc").Find(&posts)
+				cfg.db.Limit(int(iLimit)).Where("state = '' and not hidden").Order("indexed_at desc, c_id desc").Find(&posts)
 			}
 			// log.Printf("Got posts = %+v", posts)
 			if len(posts) > 0 {
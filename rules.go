@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// RuleConfig is a block of conditions on a post. A feed's rule block, and
+// any all block within it, matches when every condition and nested block in
+// it holds; an any block matches when at least one of them holds; and a not
+// block matches when its contents, taken as an all block, don't.
+//
+// Conditions taking a list hold when any value in the list does.
+type RuleConfig struct {
+	All []*RuleConfig `hcl:"all,block"`
+	Any []*RuleConfig `hcl:"any,block"`
+	Not []*RuleConfig `hcl:"not,block"`
+
+	Regex    string   `hcl:"regex,optional"`
+	Keyword  []string `hcl:"keyword,optional"`
+	Hashtag  []string `hcl:"hashtag,optional"`
+	Mention  []string `hcl:"mention,optional"`
+	Language []string `hcl:"language,optional"`
+	Author   []string `hcl:"author,optional"`
+	HasMedia *bool    `hcl:"has_media,optional"`
+	HasLink  *bool    `hcl:"has_link,optional"`
+	Domain   []string `hcl:"domain,optional"`
+	IsReply  *bool    `hcl:"is_reply,optional"`
+	Analyzer string   `hcl:"analyzer,optional"`
+	MinScore *float64 `hcl:"min_score,optional"`
+
+	kind     ruleKind
+	regex    *regexp.Regexp
+	keywords *regexp.Regexp
+	tags     []string
+	analyzer *TextAnalyzer
+	conds    []ruleCond
+}
+
+// ruleCond tests a post, given the text of the fields the feed matches on,
+// which are only worked out once for the whole rule.
+type ruleCond func(p *ParsedPost, fields *postFields) bool
+
+type ruleKind int
+
+const (
+	ruleAll ruleKind = iota
+	ruleAny
+	ruleNot
+)
+
+// compile checks the rule and everything nested in it, compiling its
+// expressions and finding the analyzers it names.
+func (rc *RuleConfig) compile(kind ruleKind, analyzers []*AnalyzerConfig) error {
+	rc.kind = kind
+	var err error
+	if rc.Regex != "" {
+		if rc.regex, err = regexp.Compile("(?i)" + rc.Regex); err != nil {
+			return fmt.Errorf("invalid rule regex %q: %w", rc.Regex, err)
+		}
+	}
+	if len(rc.Keyword) > 0 {
+		words := make([]string, len(rc.Keyword))
+		for i, word := range rc.Keyword {
+			words[i] = regexp.QuoteMeta(word)
+		}
+		// \b only knows ASCII word characters, so words are bounded by
+		// anything that isn't a letter, mark, digit or underscore in any script
+		rc.keywords = regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{M}\p{N}_])(?:` + strings.Join(words, "|") + `)(?:$|[^\p{L}\p{M}\p{N}_])`)
+	}
+	rc.tags = normalizeTags(rc.Hashtag)
+	if rc.Analyzer != "" {
+		i := slices.IndexFunc(analyzers, func(ac *AnalyzerConfig) bool { return ac.ID == rc.Analyzer })
+		if i < 0 {
+			return fmt.Errorf("rule names unknown analyzer %q", rc.Analyzer)
+		}
+		ac := analyzers[i]
+		rc.analyzer = NewTextAnalyzer(ac.Triggers, ac.Patterns, ac.Threshold, ac.AnyTrigger)
+	} else if rc.MinScore != nil {
+		return fmt.Errorf("rule min_score needs an analyzer")
+	}
+	rc.conds = rc.conditions()
+	if len(rc.conds) == 0 && len(rc.All)+len(rc.Any)+len(rc.Not) == 0 {
+		return fmt.Errorf("rule block has no conditions")
+	}
+	for _, sub := range rc.All {
+		if err := sub.compile(ruleAll, analyzers); err != nil {
+			return err
+		}
+	}
+	for _, sub := range rc.Any {
+		if err := sub.compile(ruleAny, analyzers); err != nil {
+			return err
+		}
+	}
+	for _, sub := range rc.Not {
+		if err := sub.compile(ruleNot, analyzers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conditions returns a test for each condition set in the rule.
+func (rc *RuleConfig) conditions() []ruleCond {
+	var conds []ruleCond
+	if len(rc.tags) > 0 {
+		conds = append(conds, func(p *ParsedPost, _ *postFields) bool { return p.HasTag(rc.tags) })
+	}
+	if len(rc.Mention) > 0 {
+		conds = append(conds, func(p *ParsedPost, _ *postFields) bool { return p.HasMention(rc.Mention) })
+	}
+	if len(rc.Language) > 0 {
+		conds = append(conds, func(p *ParsedPost, _ *postFields) bool {
+			return slices.ContainsFunc(p.Langs, func(lang string) bool {
+				return slices.ContainsFunc(rc.Language, func(want string) bool { return langMatches(lang, want) })
+			})
+		})
+	}
+	if len(rc.Author) > 0 {
+		conds = append(conds, func(p *ParsedPost, _ *postFields) bool { return slices.Contains(rc.Author, p.Did) })
+	}
+	if rc.HasMedia != nil {
+		conds = append(conds, func(p *ParsedPost, _ *postFields) bool { return p.HasMedia() == *rc.HasMedia })
+	}
+	if rc.HasLink != nil {
+		conds = append(conds, func(p *ParsedPost, _ *postFields) bool { return p.HasLink() == *rc.HasLink })
+	}
+	if len(rc.Domain) > 0 {
+		conds = append(conds, func(p *ParsedPost, _ *postFields) bool {
+			return slices.ContainsFunc(p.LinkDomains(), func(host string) bool {
+				return slices.ContainsFunc(rc.Domain, func(want string) bool { return domainMatches(host, want) })
+			})
+		})
+	}
+	if rc.IsReply != nil {
+		conds = append(conds, func(p *ParsedPost, _ *postFields) bool { return p.IsReply() == *rc.IsReply })
+	}
+	// the text comes last, as matching it may mean fetching the quoted post
+	if rc.regex != nil {
+		conds = append(conds, func(_ *ParsedPost, fields *postFields) bool { return matchText(fields, rc.regex.MatchString) })
+	}
+	if rc.keywords != nil {
+		conds = append(conds, func(_ *ParsedPost, fields *postFields) bool { return matchText(fields, rc.keywords.MatchString) })
+	}
+	if rc.analyzer != nil {
+		conds = append(conds, func(_ *ParsedPost, fields *postFields) bool {
+			return matchText(fields, func(text string) bool {
+				score, matches := rc.analyzer.Score(text)
+				if rc.MinScore != nil {
+					return rc.analyzer.HasTriggers(text) && score >= *rc.MinScore
+				}
+				return matches
+			})
+		})
+	}
+	return conds
+}
+
+// matchText reports whether any of the fields satisfies match.
+func matchText(fields *postFields, match func(string) bool) bool {
+	_, ok := matchIn(fields, match)
+	return ok
+}
+
+// Matches reports whether the post, with the given fields the feed matches
+// on, satisfies the rule.
+func (rc *RuleConfig) Matches(p *ParsedPost, fields *postFields) bool {
+	// an any block is settled by the first thing that holds, and all and
+	// not blocks by the first thing that doesn't
+	settle := rc.kind == ruleAny
+	settled := slices.ContainsFunc(rc.conds, func(cond ruleCond) bool {
+		return cond(p, fields) == settle
+	})
+	for _, subs := range [][]*RuleConfig{rc.All, rc.Any, rc.Not} {
+		if settled {
+			break
+		}
+		settled = slices.ContainsFunc(subs, func(sub *RuleConfig) bool {
+			return sub.Matches(p, fields) == settle
+		})
+	}
+	if rc.kind == ruleAll {
+		return !settled
+	}
+	return settled
+}
+
+// usesAnalyzer reports whether the rule, or anything nested in it, scores
+// posts with the named analyzer.
+func (rc *RuleConfig) usesAnalyzer(id string) bool {
+	if rc == nil {
+		return false
+	}
+	if rc.Analyzer == id {
+		return true
+	}
+	for _, subs := range [][]*RuleConfig{rc.All, rc.Any, rc.Not} {
+		if slices.ContainsFunc(subs, func(sub *RuleConfig) bool { return sub.usesAnalyzer(id) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// langMatches reports whether a post language tag such as en-US is the
+// wanted language, either exactly or as a more specific form of it.
+func langMatches(lang, want string) bool {
+	return strings.EqualFold(lang, want) ||
+		len(lang) > len(want) && lang[len(want)] == '-' && strings.EqualFold(lang[:len(want)], want)
+}
+
+// domainMatches reports whether host is the wanted domain or a subdomain of
+// it.
+func domainMatches(host, want string) bool {
+	want = strings.ToLower(strings.TrimPrefix(want, "."))
+	return host == want || strings.HasSuffix(host, "."+want)
+}
+
+// HasMedia reports whether the post embeds images or a video.
+func (p *ParsedPost) HasMedia() bool {
+	return len(p.Images) > 0 || p.Video != nil
+}
+
+// HasLink reports whether the post links out, in its text or as a card.
+func (p *ParsedPost) HasLink() bool {
+	return len(p.Links) > 0 || p.External != nil
+}
+
+// LinkDomains returns the lower cased hosts of the post's links.
+func (p *ParsedPost) LinkDomains() []string {
+	uris := p.Links
+	if p.External != nil {
+		uris = append(slices.Clip(uris), p.External.URI)
+	}
+	var hosts []string
+	for _, uri := range uris {
+		if u, err := url.Parse(uri); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, strings.ToLower(u.Hostname()))
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/jetstream/pkg/client"
+	"github.com/bluesky-social/jetstream/pkg/client/schedulers/parallel"
+	"github.com/bluesky-social/jetstream/pkg/client/schedulers/sequential"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"github.com/charmbracelet/log"
+)
+
+var fSource = flag.String("source", "jetstream", "Event source: jetstream, firehose[:<relay url>] to read the full repo firehose, or file:<events.jsonl[.zst]> to replay recorded events")
+var fReplayPace = flag.String("replay-pace", "fast", "Pace to replay a file source at: fast or realtime")
+var fRecord = flag.String("record", "", "Record received events to a .jsonl or .jsonl.zst file")
+
+// eventSource is somewhere events are read from and handed to a scheduler.
+type eventSource interface {
+	// Run reads events until ctx is cancelled or the source runs out,
+	// starting at cursor where the source supports it. resume is asked for
+	// the cursor to continue from if the source has to reconnect.
+	Run(ctx context.Context, cursor int64, resume func() int64)
+	// Reconfigure applies a reloaded config to a running source.
+	Reconfigure(cfg *Config) error
+	// CursorService names the cursor saved for the source in the feed
+	// databases, or is empty if its position shouldn't be saved.
+	CursorService() string
+	// Checkpoint returns the cursor to save and resume from, given the time
+	// of the last event handled, rewound by rewind to cover events that were
+	// still queued. It returns 0 if there is nothing to resume from yet.
+	Checkpoint(handled int64, rewind time.Duration) int64
+}
+
+// newEventSource creates the source named by spec.
+func newEventSource(spec string, cfg *Config, scheduler client.Scheduler) (eventSource, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "jetstream":
+		return newJetstreamSource(cfg, scheduler)
+	case "firehose":
+		if arg == "" {
+			arg = defaultFirehoseRelay
+		}
+		return newFirehoseSource(arg, cfg, scheduler), nil
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("file source needs a path, as in file:events.jsonl")
+		}
+		if *fReplayPace != "fast" && *fReplayPace != "realtime" {
+			return nil, fmt.Errorf("unknown replay pace %q", *fReplayPace)
+		}
+		return &fileSource{
+			path:      arg,
+			realtime:  *fReplayPace == "realtime",
+			scheduler: scheduler,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown event source %q", spec)
+}
+
+// fileSource replays events recorded as lines of JSON, optionally zstd
+// compressed.
+type fileSource struct {
+	path      string
+	realtime  bool
+	scheduler client.Scheduler
+}
+
+func (s *fileSource) Reconfigure(cfg *Config) error {
+	return nil
+}
+
+func (s *fileSource) CursorService() string {
+	return ""
+}
+
+func (s *fileSource) Checkpoint(handled int64, rewind time.Duration) int64 {
+	return 0
+}
+
+// Run replays the whole file, ignoring the cursor, as a recording is usually
+// older than anything we'd have saved.
+func (s *fileSource) Run(ctx context.Context, cursor int64, resume func() int64) {
+	log.Info("Replaying events from file", "path", s.path, "realtime", s.realtime)
+	var first int64
+	started := time.Now()
+	count, err := readEventFile(ctx, s.path, func(event *models.Event) {
+		// in realtime, wait until as long has passed since we started as
+		// had passed between the first event and this one
+		if s.realtime {
+			if first == 0 {
+				first = event.TimeUS
+			}
+			wait := time.Until(started.Add(time.Duration(event.TimeUS-first) * time.Microsecond))
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		if err := s.scheduler.AddWork(ctx, event.Did, event); err != nil {
+			log.Error("Failed to add work to scheduler", "error", err)
+		}
+	})
+	if err != nil {
+		log.Error("Failed reading event file", "path", s.path, "error", err)
+	}
+	log.Info("Finished replaying events", "path", s.path, "events", count, "elapsed", time.Since(started))
+}
+
+// newScheduler creates the scheduler that hands events from the source to
+// handle, as set in the jetstream config.
+func newScheduler(jc *JetstreamConfig, handle func(context.Context, *models.Event) error) client.Scheduler {
+	if jc.Scheduler == "parallel" {
+		log.Info("Handling events in parallel", "scheduler", jc.Name, "workers", jc.Workers)
+		return parallel.NewScheduler(jc.Workers, jc.Name, slog.Default(), handle)
+	}
+	return sequential.NewScheduler(jc.Name, slog.Default(), handle)
+}
+
+// recordingScheduler writes each event to a file in the format fileSource
+// reads, before passing it on to the next scheduler.
+type recordingScheduler struct {
+	next client.Scheduler
+	w    *eventWriter
+	sync.Mutex
+}
+
+func newRecordingScheduler(path string, next client.Scheduler) (*recordingScheduler, error) {
+	w, err := openEventWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Recording events", "path", path)
+	return &recordingScheduler{next: next, w: w}, nil
+}
+
+func (rs *recordingScheduler) AddWork(ctx context.Context, repo string, evt *models.Event) error {
+	rs.Lock()
+	err := rs.w.Write(evt)
+	rs.Unlock()
+	if err != nil {
+		log.Error("Failed to record event", "error", err)
+	}
+	return rs.next.AddWork(ctx, repo, evt)
+}
+
+func (rs *recordingScheduler) Shutdown() {
+	rs.Lock()
+	defer rs.Unlock()
+	if err := rs.w.Close(); err != nil {
+		log.Error("Failed to close recording", "error", err)
+	}
+	rs.next.Shutdown()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// spillQueue is a first in, first out queue of lines kept in a file, for
+// work that doesn't fit in a worker's queue. Anything left in the file when
+// we stop is picked up again next time.
+type spillQueue struct {
+	path  string
+	w     *os.File
+	rf    *os.File
+	r     *bufio.Reader
+	head  []byte
+	count int
+	ready chan struct{}
+	sync.Mutex
+}
+
+func openSpillQueue(path string) (*spillQueue, error) {
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := os.Open(path)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	q := &spillQueue{
+		path:  path,
+		w:     w,
+		rf:    rf,
+		r:     bufio.NewReader(rf),
+		ready: make(chan struct{}, 1),
+	}
+
+	// count what was left over from last time
+	b, err := os.ReadFile(path)
+	if err != nil {
+		q.Close(nil)
+		return nil, err
+	}
+	q.count = bytes.Count(b, []byte{'\n'})
+	if q.count > 0 {
+		q.ready <- struct{}{}
+	}
+	return q, nil
+}
+
+func (q *spillQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.count
+}
+
+// Push adds a line to the end of the queue.
+func (q *spillQueue) Push(line []byte) error {
+	q.Lock()
+	defer q.Unlock()
+	if _, err := q.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.count++
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns the line at the front of the queue, if there is one, leaving
+// it there until Commit.
+func (q *spillQueue) Peek() ([]byte, bool, error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.count == 0 {
+		return nil, false, nil
+	}
+	if q.head == nil {
+		line, err := q.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		q.head = line
+	}
+	return bytes.TrimSuffix(q.head, []byte{'\n'}), true, nil
+}
+
+// Commit takes the line returned by Peek off the queue. Once the queue is
+// empty the file is truncated, so it doesn't grow forever.
+func (q *spillQueue) Commit() error {
+	q.Lock()
+	defer q.Unlock()
+	if q.head == nil {
+		return nil
+	}
+	q.head = nil
+	q.count--
+	if q.count == 0 {
+		if err := q.w.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := q.rf.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		q.r.Reset(q.rf)
+	}
+	return nil
+}
+
+// Ready is signalled when lines may be waiting in the queue.
+func (q *spillQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Close closes the queue, leaving only front, followed by the lines not yet
+// taken, in the file.
+func (q *spillQueue) Close(front [][]byte) error {
+	q.Lock()
+	defer q.Unlock()
+	rest, err := io.ReadAll(q.r)
+	rest = append(q.head, rest...)
+	var b []byte
+	for _, line := range front {
+		b = append(append(b, line...), '\n')
+	}
+	rest = append(b, rest...)
+	q.rf.Close()
+	q.w.Close()
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, rest, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -10,6 +12,24 @@ import (
 
 const maxQueueSize = 256
 
+// OverloadPolicy decides what AddWork does when the work queue is full.
+type OverloadPolicy string
+
+const (
+	OverloadBlock      OverloadPolicy = "block"
+	OverloadDropOldest OverloadPolicy = "drop-oldest"
+	OverloadDropNewest OverloadPolicy = "drop-newest"
+	OverloadSpill      OverloadPolicy = "spill"
+)
+
+func validOverloadPolicy(p OverloadPolicy) bool {
+	switch p {
+	case OverloadBlock, OverloadDropOldest, OverloadDropNewest, OverloadSpill:
+		return true
+	}
+	return false
+}
+
 type WorkItem struct {
 	name             string
 	seq              int
@@ -17,6 +37,7 @@ type WorkItem struct {
 	retriesAvailable int
 	retryAfter       time.Time
 	attempts         int
+	done             func()
 }
 
 type WorkItemResult struct {
@@ -35,7 +56,7 @@ var dummyBackoffFunc = func(attempt int) time.Duration {
 
 type Worker struct {
 	name           string
-	work           chan *WorkItem
+	work           *workQueue
 	retriable      chan *WorkItem
 	maxRetries     int
 	handler        WorkHandler
@@ -47,6 +68,15 @@ type Worker struct {
 	ctxCancel      context.CancelFunc
 	backoff        RetryBackoffFunc
 	logger         *log.Logger
+	overload       OverloadPolicy
+	spill          *spillQueue
+	decode         func([]byte) (any, error)
+	keep           func(any) bool
+	dropped        atomic.Int64
+	spilled        atomic.Int64
+	wg             sync.WaitGroup
+	holding        bool
+	held           []*WorkItem
 	sync.Mutex
 }
 
@@ -58,7 +88,7 @@ func NewWorker(name string, handler WorkHandler, maxRetries int, maxConcurrency
 	w := &Worker{
 		name:           name,
 		handler:        handler,
-		work:           make(chan *WorkItem, maxQueueSize),
+		work:           newWorkQueue(maxQueueSize),
 		retriable:      make(chan *WorkItem, maxQueueSize),
 		maxRetries:     maxRetries,
 		maxConcurrency: maxConcurrency,
@@ -72,6 +102,80 @@ func NewWorker(name string, handler WorkHandler, maxRetries int, maxConcurrency
 	return w
 }
 
+// SetOverload sets what happens to new work when the queue is full. Work is
+// spilled to a file at spillPath for OverloadSpill, and decode turns it back
+// into a payload. Work that keep reports true for, if keep is set, is never
+// dropped, and waits for room instead. It must be called before Start.
+func (w *Worker) SetOverload(policy OverloadPolicy, spillPath string, decode func([]byte) (any, error), keep func(any) bool) error {
+	w.overload = policy
+	w.keep = keep
+	if policy == OverloadSpill {
+		spill, err := openSpillQueue(spillPath)
+		if err != nil {
+			return err
+		}
+		w.spill = spill
+		w.decode = decode
+	}
+	return nil
+}
+
+// Dropped returns how many payloads have been dropped as the queue was full.
+func (w *Worker) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// Spilled returns how many payloads have been spilled to disk as the queue
+// was full.
+func (w *Worker) Spilled() int64 {
+	return w.spilled.Load()
+}
+
+// Backlog returns how many payloads are waiting to be worked on.
+func (w *Worker) Backlog() int {
+	n := w.work.Len()
+	if w.spill != nil {
+		n += w.spill.Len()
+	}
+	w.Lock()
+	n += len(w.held)
+	w.Unlock()
+	return n
+}
+
+// Hold holds back new work, however much of it there is, until Release.
+func (w *Worker) Hold() {
+	w.Lock()
+	defer w.Unlock()
+	w.holding = true
+}
+
+// Release queues the work held back since Hold, in order, and goes back to
+// queueing new work as it comes.
+func (w *Worker) Release() {
+	for {
+		w.Lock()
+		held := w.held
+		w.held = nil
+		if len(held) == 0 {
+			w.holding = false
+			w.Unlock()
+			return
+		}
+		w.Unlock()
+		// work added meanwhile is held behind these
+		for _, wi := range held {
+			w.queue(wi)
+		}
+	}
+}
+
+// Context returns a context that is done once the worker is stopping, for
+// handlers to give up on slow work.
+func (w *Worker) Context() context.Context {
+	return w.ctx
+}
+
 func (w *Worker) getSeq() int {
 	w.Lock()
 	defer w.Unlock()
@@ -80,67 +184,26 @@ func (w *Worker) getSeq() int {
 }
 
 func (w *Worker) runner(ctx context.Context, idNum int) {
+	defer w.wg.Done()
 	for {
 		select {
 		case <-ctx.Done():
 			w.logger.Info("Worker stopping", "worker", w.name, "idnum", idNum, "reason", ctx.Err())
 			return
-		case wi := <-w.work:
-			if wi != nil {
-				if w.handler != nil {
-					err, isFatal := w.handler(wi)
-					if err != nil {
-						w.logger.Error("Worker failed processing job", "worker", w.name, "job_id", wi.seq, "error", err)
-						if isFatal || wi.retriesAvailable < 1 {
-							if w.useDlq {
-								w.dlq <- &WorkItemResult{
-									item:   wi,
-									reason: err,
-								}
-							}
-						} else {
-							f := w.backoff
-							if f == nil {
-								f = dummyBackoffFunc
-							}
-							delay := f(wi.attempts)
-							wi.attempts++
-							wi.retryAfter = time.Now().Add(delay)
-							wi.retriesAvailable--
-							w.retriable <- wi
-							w.logger.Info("Worker scheduled retry for job", "worker", w.name, "job_id", wi.seq, "retry_in", delay)
-						}
-					}
+		case <-w.work.Ready():
+			// once stopping, queued work is left for Stop, which finishes
+			// or spills it
+			for ctx.Err() == nil {
+				wi := w.work.pop()
+				if wi == nil {
+					break
 				}
+				w.run(wi, false)
 			}
 		case wi := <-w.retriable:
 			if wi != nil {
 				if !time.Now().Before(wi.retryAfter) {
-					if w.handler != nil {
-						err, isFatal := w.handler(wi)
-						if err != nil {
-							w.logger.Error("Worker failed processing job on retry", "worker", w.name, "job_id", wi.seq, "error", err)
-							if isFatal || wi.retriesAvailable < 1 {
-								if w.useDlq {
-									w.dlq <- &WorkItemResult{
-										item:   wi,
-										reason: err,
-									}
-								}
-							} else {
-								f := w.backoff
-								if f == nil {
-									f = dummyBackoffFunc
-								}
-								delay := f(wi.attempts)
-								wi.attempts++
-								wi.retryAfter = time.Now().Add(delay)
-								wi.retriesAvailable--
-								w.retriable <- wi
-								w.logger.Info("Worker scheduled retry for job", "worker", w.name, "job_ud", wi.seq, "retry_in", delay)
-							}
-						}
-					}
+					w.run(wi, true)
 				} else {
 					if w.retriable != nil {
 						w.retriable <- wi
@@ -154,30 +217,164 @@ func (w *Worker) runner(ctx context.Context, idNum int) {
 	}
 }
 
+// run hands a work item to the handler, scheduling a retry if it fails and
+// has retries left, and otherwise finishing with it.
+func (w *Worker) run(wi *WorkItem, retry bool) {
+	if w.handler == nil {
+		w.finish(wi)
+		return
+	}
+	err, isFatal := w.handler(wi)
+	if err == nil {
+		w.finish(wi)
+		return
+	}
+	if retry {
+		w.logger.Error("Worker failed processing job on retry", "worker", w.name, "job_id", wi.seq, "error", err)
+	} else {
+		w.logger.Error("Worker failed processing job", "worker", w.name, "job_id", wi.seq, "error", err)
+	}
+	if isFatal || wi.retriesAvailable < 1 {
+		if w.useDlq {
+			w.dlq <- &WorkItemResult{
+				item:   wi,
+				reason: err,
+			}
+		}
+		w.finish(wi)
+		return
+	}
+	f := w.backoff
+	if f == nil {
+		f = dummyBackoffFunc
+	}
+	delay := f(wi.attempts)
+	wi.attempts++
+	wi.retryAfter = time.Now().Add(delay)
+	wi.retriesAvailable--
+	w.retriable <- wi
+	w.logger.Info("Worker scheduled retry for job", "worker", w.name, "job_id", wi.seq, "retry_in", delay)
+}
+
+// finish lets whoever queued a work item know it is done with.
+func (w *Worker) finish(wi *WorkItem) {
+	if wi.done != nil {
+		wi.done()
+	}
+}
+
 func (w *Worker) Start() {
 	for i := 0; i < w.maxConcurrency; i++ {
-		ctx, _ := context.WithCancel(w.ctx)
 		ii := i
-		go w.runner(ctx, ii)
+		w.wg.Add(1)
+		go w.runner(w.ctx, ii)
 		w.logger.Info("Worker starting", "worker", w.name, "id", i)
 	}
+	if w.spill != nil {
+		w.wg.Add(1)
+		go w.unspill(w.ctx)
+	}
+}
+
+// unspill feeds spilled work back into the queue as there is room.
+func (w *Worker) unspill(ctx context.Context) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.spill.Ready():
+		}
+		for {
+			line, ok, err := w.spill.Peek()
+			if err != nil {
+				w.logger.Error("Worker failed reading spilled work", "worker", w.name, "error", err)
+				break
+			}
+			if !ok {
+				break
+			}
+			payload, err := w.decode(line)
+			if err != nil {
+				w.logger.Error("Worker failed decoding spilled work", "worker", w.name, "error", err)
+			} else if !w.work.push(ctx, w.newWorkItem(payload)) {
+				return
+			}
+			// the spill only counts as empty once its last line is queued,
+			// so that new work can't overtake it
+			if err := w.spill.Commit(); err != nil {
+				w.logger.Error("Worker failed truncating spill file", "worker", w.name, "error", err)
+				break
+			}
+		}
+	}
 }
 
 func (w *Worker) Stop() {
 	w.ctxCancel()
-	workRemaining := len(w.work)
+	w.wg.Wait()
+	if w.spill != nil {
+		if err := w.spill.Close(w.respill()); err != nil {
+			log.Error("Worker failed closing spill file", "worker", w.name, "error", err)
+		}
+	}
+	w.finishTracked()
+	workRemaining := w.work.Len()
 	retriesRemaining := len(w.retriable)
 	dlqRemaining := len(w.dlq)
 	if workRemaining+retriesRemaining+dlqRemaining > 0 {
 		log.Warn("Worker has remaining in flight work at shutdown", "worker", w.name, "new_items", workRemaining, "retry_items", retriesRemaining, "dlq_items", dlqRemaining)
 	}
-	close(w.work)
 	close(w.retriable)
 	close(w.dlq)
 }
 
-func (w *Worker) AddWork(payload any) {
-	w.work <- &WorkItem{
+// respill takes everything still queued once the runners have stopped, to
+// go back in front of the spill file. Work taken from the spill was already
+// committed out of it, and anything queued after it has to stay behind it.
+func (w *Worker) respill() [][]byte {
+	items := w.work.drain()
+	for n := len(w.retriable); n > 0; n-- {
+		items = append(items, <-w.retriable)
+	}
+	var lines [][]byte
+	for _, wi := range items {
+		b, err := json.Marshal(wi.payload)
+		if err != nil {
+			w.logger.Error("Worker failed spilling work at shutdown", "worker", w.name, "error", err)
+			w.work.tryPush(wi)
+			continue
+		}
+		lines = append(lines, b)
+		w.finish(wi)
+	}
+	return lines
+}
+
+// finishTracked works through the queued items that someone is waiting on,
+// once the runners have stopped, giving each one last try. Anything else
+// queued is left behind.
+func (w *Worker) finishTracked() {
+	items := w.work.drain()
+	for n := len(w.retriable); n > 0; n-- {
+		items = append(items, <-w.retriable)
+	}
+	for _, wi := range items {
+		if wi.done == nil {
+			w.work.tryPush(wi)
+			continue
+		}
+		if w.handler != nil {
+			if err, _ := w.handler(wi); err != nil {
+				w.logger.Error("Worker failed processing job at shutdown", "worker", w.name, "job_id", wi.seq, "error", err)
+			}
+		}
+		wi.done()
+	}
+}
+
+func (w *Worker) newWorkItem(payload any) *WorkItem {
+	return &WorkItem{
 		name:             w.name,
 		seq:              w.getSeq(),
 		payload:          payload,
@@ -185,3 +382,91 @@ func (w *Worker) AddWork(payload any) {
 		retryAfter:       time.Now(),
 	}
 }
+
+// AddWork queues a payload for the handler, following the overload policy
+// if the queue is full.
+func (w *Worker) AddWork(payload any) {
+	w.AddWorkDone(payload, nil)
+}
+
+// AddWorkDone queues a payload like AddWork, calling done once the handler
+// has finished with it, or it has been dropped or spilled to disk.
+func (w *Worker) AddWorkDone(payload any, done func()) {
+	wi := w.newWorkItem(payload)
+	wi.done = done
+	w.Lock()
+	if w.holding {
+		w.held = append(w.held, wi)
+		w.Unlock()
+		return
+	}
+	w.Unlock()
+	w.queue(wi)
+}
+
+// queue puts a work item on the queue, following the overload policy if it
+// is full.
+func (w *Worker) queue(wi *WorkItem) {
+	switch w.overload {
+	case OverloadDropNewest:
+		if !w.work.tryPush(wi) {
+			if w.mustKeep(wi) {
+				w.work.push(w.ctx, wi)
+				return
+			}
+			w.drop(wi)
+		}
+	case OverloadDropOldest:
+		for !w.work.tryPush(wi) {
+			if old := w.work.dropOldest(w.mustKeep); old != nil {
+				w.drop(old)
+				continue
+			}
+			// everything queued has to be kept
+			if w.mustKeep(wi) {
+				w.work.push(w.ctx, wi)
+			} else {
+				w.drop(wi)
+			}
+			return
+		}
+	case OverloadSpill:
+		// once anything is spilled, new work has to follow it to keep
+		// things in order
+		if w.spill.Len() == 0 && w.work.tryPush(wi) {
+			return
+		}
+		b, err := json.Marshal(wi.payload)
+		if err == nil {
+			err = w.spill.Push(b)
+		}
+		if err != nil {
+			w.logger.Error("Worker failed spilling work", "worker", w.name, "error", err)
+			if w.mustKeep(wi) {
+				w.work.push(w.ctx, wi)
+				return
+			}
+			w.drop(wi)
+			return
+		}
+		// spilled work is picked up again from the file after a restart
+		w.finish(wi)
+		if n := w.spilled.Add(1); n%1000 == 1 {
+			w.logger.Warn("Worker is behind, spilling work to disk", "worker", w.name, "spilled", n)
+		}
+	default:
+		w.work.push(w.ctx, wi)
+	}
+}
+
+// mustKeep reports whether a work item mustn't be dropped.
+func (w *Worker) mustKeep(wi *WorkItem) bool {
+	return w.keep != nil && w.keep(wi.payload)
+}
+
+func (w *Worker) drop(wi *WorkItem) {
+	w.finish(wi)
+	if n := w.dropped.Add(1); n%1000 == 1 {
+		w.logger.Warn("Worker is behind, dropping work", "worker", w.name, "policy", w.overload, "dropped", n)
+	}
+}
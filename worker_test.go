@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func decodeInt(b []byte) (any, error) {
+	var n int
+	err := json.Unmarshal(b, &n)
+	return n, err
+}
+
+// recordHandler remembers the payloads it is given, in order, holding up
+// the one equal to blockAt until release is closed.
+type recordHandler struct {
+	blockAt int
+	reached chan struct{}
+	release chan struct{}
+	handled []int
+	sync.Mutex
+}
+
+func newRecordHandler(blockAt int) *recordHandler {
+	return &recordHandler{
+		blockAt: blockAt,
+		reached: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (rh *recordHandler) handle(job *WorkItem) (error, bool) {
+	n := job.payload.(int)
+	rh.Lock()
+	rh.handled = append(rh.handled, n)
+	rh.Unlock()
+	if n == rh.blockAt {
+		close(rh.reached)
+		<-rh.release
+	}
+	return nil, false
+}
+
+func (rh *recordHandler) Handled() []int {
+	rh.Lock()
+	defer rh.Unlock()
+	return slices.Clone(rh.handled)
+}
+
+func TestWorkerStopFinishesQueuedWork(t *testing.T) {
+	rh := newRecordHandler(0)
+	w := NewWorker("test", rh.handle, 0, 1, false, nil, nil)
+	w.Start()
+	var done atomic.Int64
+	for i := 0; i < 10; i++ {
+		w.AddWorkDone(i, func() { done.Add(1) })
+	}
+	<-rh.reached
+
+	// stop while the first item is being worked on and the rest are queued
+	w.ctxCancel()
+	close(rh.release)
+	w.Stop()
+	if n := done.Load(); n != 10 {
+		t.Errorf("done called for %d of 10 items", n)
+	}
+}
+
+func TestWorkerSpillSurvivesRestart(t *testing.T) {
+	const total = 600
+	path := filepath.Join(t.TempDir(), "test.spill")
+
+	// the first run stops partway, with work taken back out of the spill
+	// file still queued
+	first := newRecordHandler(300)
+	w := NewWorker("test", first.handle, 0, 1, false, nil, nil)
+	if err := w.SetOverload(OverloadSpill, path, decodeInt, nil); err != nil {
+		t.Fatal(err)
+	}
+	var done atomic.Int64
+	for i := 0; i < total; i++ {
+		w.AddWorkDone(i, func() { done.Add(1) })
+	}
+	if w.Spilled() == 0 {
+		t.Fatal("nothing was spilled")
+	}
+	w.Start()
+	<-first.reached
+	w.ctxCancel()
+	close(first.release)
+	w.Stop()
+	if n := done.Load(); n != total {
+		t.Errorf("done called for %d of %d items", n, total)
+	}
+
+	second := newRecordHandler(-1)
+	w = NewWorker("test", second.handle, 0, 1, false, nil, nil)
+	if err := w.SetOverload(OverloadSpill, path, decodeInt, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	want := total - len(first.Handled())
+	deadline := time.Now().Add(10 * time.Second)
+	for len(second.Handled()) < want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.Stop()
+
+	handled := append(first.Handled(), second.Handled()...)
+	if len(handled) != total {
+		t.Fatalf("handled %d items, want %d", len(handled), total)
+	}
+	for i, n := range handled {
+		if n != i {
+			t.Fatalf("item %d was %d, want every item once and in order", i, n)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// workQueue is a bounded first in, first out queue of work items. Unlike a
+// channel, items can be dropped from anywhere in it, so that making room
+// can pass over work that mustn't be dropped.
+type workQueue struct {
+	items []*WorkItem
+	size  int
+	ready chan struct{}
+	room  chan struct{}
+	sync.Mutex
+}
+
+func newWorkQueue(size int) *workQueue {
+	return &workQueue{
+		size:  size,
+		ready: make(chan struct{}, 1),
+		room:  make(chan struct{}, 1),
+	}
+}
+
+func (q *workQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+// Ready is signalled when items may be waiting in the queue.
+func (q *workQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// tryPush adds an item to the end of the queue, if there is room.
+func (q *workQueue) tryPush(wi *WorkItem) bool {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) >= q.size {
+		return false
+	}
+	q.items = append(q.items, wi)
+	notify(q.ready)
+	return true
+}
+
+// push adds an item to the end of the queue, waiting for room, and reports
+// whether it did before ctx was done.
+func (q *workQueue) push(ctx context.Context, wi *WorkItem) bool {
+	for !q.tryPush(wi) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-q.room:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// pop takes the item from the front of the queue, if there is one.
+func (q *workQueue) pop() *WorkItem {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	wi := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	notify(q.room)
+	return wi
+}
+
+// dropOldest takes the oldest item out of the queue that keep doesn't say
+// must stay, returning nil if there isn't one.
+func (q *workQueue) dropOldest(keep func(*WorkItem) bool) *WorkItem {
+	q.Lock()
+	defer q.Unlock()
+	for i, wi := range q.items {
+		if keep(wi) {
+			continue
+		}
+		q.items = append(q.items[:i], q.items[i+1:]...)
+		notify(q.room)
+		return wi
+	}
+	return nil
+}
+
+// drain empties the queue, returning what was in it.
+func (q *workQueue) drain() []*WorkItem {
+	q.Lock()
+	defer q.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+// notify wakes whoever is waiting on ch, if they aren't already woken.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}